@@ -2,20 +2,70 @@ package dnssd
 
 import (
 	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 const (
-	periodicUpdateInterval = time.Second * 1
+	// Continuous querying parameters (RFC 6762 Section 5.2)
+	initialQueryInterval = time.Second
+	maxInitialQueryDelay = 120 * time.Millisecond
+	maxQueryInterval     = time.Hour
+	minInitialQueryDelay = 20 * time.Millisecond
+
+	// Our own query is suppressed by a duplicate query from another host only if ours is due within this
+	// long (RFC 6762 Section 7.3).
+	duplicateQuestionWindow = 500 * time.Millisecond
 )
 
+// continuousQuery schedules the repeated questions of an ongoing query, such as browsing for a service.
+// The first question is asked after a short random delay, after which the interval between questions
+// doubles from one second up to one hour (RFC 6762 Section 5.2).
+type continuousQuery struct {
+	interval      time.Duration
+	nextQueryTime time.Time
+	queriesSent   int
+}
+
+// newContinuousQuery creates a new continuous query whose first question is due after a random delay
+// of 20 to 120 milliseconds.
+func newContinuousQuery(now time.Time) *continuousQuery {
+	delay := minInitialQueryDelay + time.Duration(rand.Int63n(int64(maxInitialQueryDelay-minInitialQueryDelay)))
+
+	return &continuousQuery{
+		interval:      initialQueryInterval,
+		nextQueryTime: now.Add(delay),
+	}
+}
+
+// WithUnicastFirstQuery makes the resolver set the unicast-response bit on the first query for each
+// service it browses for, asking responders to reply directly to it rather than multicasting their
+// answers to the whole network (RFC 6762 Section 5.4). Later queries ask for multicast responses so that
+// other hosts can keep their caches up to date.
+func WithUnicastFirstQuery() ResolverOption {
+	return func(r *Resolver) {
+		r.unicastFirstQuery = true
+	}
+}
+
+// earlierTime returns the earlier of the two times, ignoring zero times.
+func earlierTime(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
+
 // browse browses for service instances on the local network.
 func (r *Resolver) browse() {
 	defer r.close()
 
-	r.periodicUpdateTimer = timerCreate()
-	timerReset(r.periodicUpdateTimer, periodicUpdateInterval)
-
 	for {
 		select {
 		case <-r.shutdownCh:
@@ -24,24 +74,89 @@ func (r *Resolver) browse() {
 		case answers := <-r.messagePipeline.answerCh:
 			r.onAnswersReceived(answers)
 
+		case query := <-r.messagePipeline.queryCh:
+			r.observeQuery(query)
+			r.onQueryReceived(query)
+
 		case request := <-r.getResolvedInstancesCh:
 			r.onGetResolvedInstances(request)
 
+		case responseCh := <-r.getServiceTypesCh:
+			r.onGetServiceTypes(responseCh)
+
+		case request := <-r.registerCh:
+			r.onServiceRegistered(request)
+
+		case instanceName := <-r.unregisterCh:
+			r.onServiceUnregistered(instanceName)
+
+		case request := <-r.lookupAddrCh:
+			r.onLookupAddrRequested(request)
+
+		case request := <-r.lookupHostCh:
+			r.onLookupHostRequested(request)
+
+		case request := <-r.hostQueryCh:
+			r.onHostQueryRequested(request)
+
+		case q := <-r.recordQueryCh:
+			r.onRecordQueryRequested(q)
+
+		case q := <-r.recordQueryDoneCh:
+			r.onRecordQueryDone(q)
+
+		case instanceName := <-r.reconfirmCh:
+			r.onReconfirmRequested(instanceName)
+
+		case request := <-r.resolveCh:
+			r.onResolveRequested(request)
+
+		case request := <-r.subscribeCh:
+			r.onSubscribe(request)
+
+		case ch := <-r.unsubscribeCh:
+			r.onUnsubscribe(ch)
+
 		case serviceName := <-r.serviceAddCh:
 			log.Printf("Adding service %v\n", serviceName)
 			r.onServiceAdded(serviceName)
 
-		case <-r.periodicUpdateTimer.C:
-			log.Printf("Cache update timer fired\n")
-			r.onPeriodicUpdate()
+		case <-r.updateTimer.C():
+			r.onUpdateTimer()
+
+		case <-r.registrationTimer.C():
+			r.onRegistrationTimer()
+
+		case <-r.responseTimer.C():
+			r.onResponseTimer()
+
+		case <-r.truncatedQueryTimer.C():
+			r.onTruncatedQueryTimer()
 		}
 	}
 }
 
 // close cleans up all resources owned by the resolver.
 func (r *Resolver) close() {
+	// Registrations are removed one at a time, so that the goodbye for the last service on each host
+	// includes the host's address records
+	for instanceName, reg := range r.registrations {
+		reg.cancel()
+		r.sendGoodbye(reg)
+		delete(r.registrations, instanceName)
+	}
+
+	for _, s := range r.subscriptions {
+		s.close()
+	}
+
+	for _, q := range r.recordQueries {
+		q.close()
+	}
+
 	r.netClient.close()
 	r.messagePipeline.close()
+	close(r.closedCh)
 }
 
 // onAnswersReceived handles receiving DNS answers.
@@ -54,6 +169,11 @@ func (r *Resolver) onAnswersReceived(answers answerSet) {
 		r.cache.onAddressRecordReceived(record)
 	}
 
+	for _, record := range answers.genericRecords {
+		log.Printf("Received %v record %v, ttl = %v\n", record.getQuestionType(), record.getName(), record.remainingTimeToLive)
+		r.cache.onGenericRecordReceived(record)
+	}
+
 	for _, record := range answers.pointerRecords {
 		log.Printf("Received pointer record %v, ttl = %v\n", record.instanceName, record.remainingTimeToLive)
 		r.cache.onPointerRecordReceived(record)
@@ -69,12 +189,29 @@ func (r *Resolver) onAnswersReceived(answers answerSet) {
 		r.cache.onTextRecordReceived(record)
 	}
 
+	r.checkForNameConflicts(answers)
+	r.suppressDuplicateAnswers(answers)
 	r.onCacheUpdated()
+	r.checkPendingHostQueries(answers)
+	r.sendMissingRecordQuestions()
+	r.scheduleUpdateTimer()
 }
 
 // onCacheUpdated handles updating the resolver's state whenever the cache has been modified.
 func (r *Resolver) onCacheUpdated() {
-	r.resolvedInstances = r.cache.toResolvedInstances()
+	resolvedInstances := r.cache.toResolvedInstances()
+	r.notifySubscribers(r.resolvedInstances, resolvedInstances)
+	r.resolvedInstances = resolvedInstances
+
+	serviceTypes := r.cache.getServiceTypes()
+	r.notifyServiceTypeSubscribers(r.serviceTypes, serviceTypes)
+	r.serviceTypes = serviceTypes
+
+	r.checkPendingResolves()
+	r.checkPendingHostLookups()
+	r.checkPendingAddrLookups()
+	r.prunePendingHostQueries()
+	r.checkRecordQueries()
 }
 
 // onGetResolvedInstances handles a request to get all resolved service instances.
@@ -87,15 +224,20 @@ func (r *Resolver) onGetResolvedInstances(request getResolvedInstancesRequest) {
 	request.responseCh <- instances
 }
 
-// onPeriodicUpdate handles updating the cache when the cache update timer fires.
-func (r *Resolver) onPeriodicUpdate() {
-	r.onTimeElapsed()
-	r.onCacheUpdated()
-	r.sendOutstandingQuestions()
-	timerReset(r.periodicUpdateTimer, periodicUpdateInterval)
+// onGetServiceTypes handles a request to get all service types discovered through service type
+// enumeration.
+func (r *Resolver) onGetServiceTypes(responseCh chan []string) {
+	serviceTypes := make([]string, 0, len(r.serviceTypes))
+	for serviceType := range r.serviceTypes {
+		serviceTypes = append(serviceTypes, serviceType.String())
+	}
+
+	sort.Strings(serviceTypes)
+	responseCh <- serviceTypes
 }
 
-// onServiceAdded handles adding a new service to browse for.
+// onServiceAdded handles adding a new service to browse for. The service's first query is sent after a
+// short random delay.
 func (r *Resolver) onServiceAdded(name serviceName) {
 	if r.browseSet[name] {
 		// We were already browsing for this service
@@ -103,22 +245,14 @@ func (r *Resolver) onServiceAdded(name serviceName) {
 	}
 
 	r.browseSet[name] = true
-
-	question := question{
-		name:         name.String(),
-		questionType: questionTypePointer,
-	}
-
-	err := r.netClient.sendQuestion(question)
-	if err != nil {
-		log.Printf("dnssd: failed sending pointer question: %v", err)
-	}
+	r.browseQueries[name] = newContinuousQuery(r.clock.Now())
+	r.scheduleUpdateTimer()
 }
 
 // onTimeElapsed updates the resolver's cache based on how long it has been since the cache was
 // last updated.
 func (r *Resolver) onTimeElapsed() {
-	now := time.Now()
+	now := r.clock.Now()
 	duration := now.Sub(r.lastCacheUpdate)
 
 	r.cache.onTimeElapsed(duration)
@@ -126,12 +260,139 @@ func (r *Resolver) onTimeElapsed() {
 	r.lastCacheUpdate = now
 }
 
-// sendOutstandingQuestions sends all questions needed to resolve the set of services being browsed for based on the
-// current state of the cache.
-func (r *Resolver) sendOutstandingQuestions() {
+// onUpdateTimer handles the update timer firing when the next record expires, a record needs to be
+// refreshed, or a continuous query is due.
+func (r *Resolver) onUpdateTimer() {
+	r.onTimeElapsed()
+	r.onCacheUpdated()
+	r.sendDueQuestions()
+	r.scheduleUpdateTimer()
+}
+
+// scheduleUpdateTimer schedules the update timer to fire when the next continuous query is due or the
+// next record in the cache needs to be refreshed or expires.
+func (r *Resolver) scheduleUpdateTimer() {
+	var nextUpdateTime time.Time
+	for _, q := range r.browseQueries {
+		nextUpdateTime = earlierTime(nextUpdateTime, q.nextQueryTime)
+	}
+
+	for _, request := range r.pendingResolves {
+		nextUpdateTime = earlierTime(nextUpdateTime, request.query.nextQueryTime)
+	}
+
+	for _, request := range r.pendingHostLookups {
+		nextUpdateTime = earlierTime(nextUpdateTime, request.query.nextQueryTime)
+	}
+
+	for _, request := range r.pendingAddrLookups {
+		nextUpdateTime = earlierTime(nextUpdateTime, request.query.nextQueryTime)
+	}
+
+	for _, query := range r.reconfirmations {
+		nextUpdateTime = earlierTime(nextUpdateTime, query.nextQueryTime)
+	}
+
+	for _, q := range r.recordQueries {
+		nextUpdateTime = earlierTime(nextUpdateTime, q.query.nextQueryTime)
+	}
+
+	if untilNextEvent, ok := r.cache.getTimeUntilNextEvent(r.browseSet, r.getRecordQuestions()); ok {
+		nextUpdateTime = earlierTime(nextUpdateTime, r.lastCacheUpdate.Add(untilNextEvent))
+	}
+
+	if nextUpdateTime.IsZero() {
+		timerStop(r.updateTimer)
+		return
+	}
+
+	timerReset(r.updateTimer, nextUpdateTime.Sub(r.clock.Now()))
+}
+
+// sendDueQuestions sends the questions of all continuous queries, including record queries, and
+// reconfirmations that are due along with the questions to refresh records that are close to expiring.
+func (r *Resolver) sendDueQuestions() {
+	now := r.clock.Now()
 	questionSet := make(map[question]bool)
-	r.cache.getQuestionsForExpiringRecords(r.browseSet, questionSet)
-	r.cache.getQuestionsForMissingRecords(r.browseSet, questionSet)
+
+	for name, q := range r.browseQueries {
+		if !q.isDue(now) {
+			continue
+		}
+
+		pointerQuestion := question{
+			name:            name.String(),
+			questionType:    questionTypePointer,
+			unicastResponse: r.unicastFirstQuery && q.queriesSent == 0,
+		}
+
+		questionSet[pointerQuestion] = true
+		r.cache.getQuestionsForMissingRecords(map[serviceName]bool{name: true}, questionSet)
+		q.onQuerySent(now)
+	}
+
+	for _, q := range r.recordQueries {
+		if q.query.isDue(now) {
+			questionSet[q.question] = true
+			q.query.onQuerySent(now)
+		}
+	}
+
+	r.cache.getQuestionsForRefresh(r.browseSet, r.getRecordQuestions(), questionSet)
+	r.getQuestionsForReconfirmations(questionSet)
+
+	addressRecords := addressRecordsByHostName(r.cache.addressRecords)
+	for _, request := range r.pendingResolves {
+		if request.query.isDue(now) {
+			instanceName := r.cache.getCachedInstanceName(request.instanceName)
+			r.cache.getQuestionsForMissingInstanceRecords(instanceName, addressRecords, questionSet)
+			request.query.onQuerySent(now)
+		}
+	}
+
+	for _, request := range r.pendingHostLookups {
+		if request.query.isDue(now) {
+			for q := range getHostAddressQuestions(request.hostName) {
+				questionSet[q] = true
+			}
+
+			request.query.onQuerySent(now)
+		}
+	}
+
+	for _, request := range r.pendingAddrLookups {
+		if request.query.isDue(now) {
+			questionSet[getReverseQuestion(request.reverseName)] = true
+			request.query.onQuerySent(now)
+		}
+	}
+
+	r.sendQuestionSet(questionSet)
+}
+
+// sendMissingRecordQuestions sends the questions for records needed to resolve instances of the services
+// being browsed for that are missing from the cache. Each missing record is asked for once; if it is
+// still missing, it is asked for again along with the next query for its service.
+func (r *Resolver) sendMissingRecordQuestions() {
+	missingQuestions := make(map[question]bool)
+	r.cache.getQuestionsForMissingRecords(r.browseSet, missingQuestions)
+
+	questionSet := make(map[question]bool)
+	for q := range missingQuestions {
+		if !r.missingQuestionsAsked[q] {
+			questionSet[q] = true
+		}
+	}
+
+	r.missingQuestionsAsked = missingQuestions
+	r.sendQuestionSet(questionSet)
+}
+
+// sendQuestionSet sends the given set of questions in a single query, if there are any.
+func (r *Resolver) sendQuestionSet(questionSet map[question]bool) {
+	if len(questionSet) == 0 {
+		return
+	}
 
 	questions := make([]question, 0, len(questionSet))
 	for q := range questionSet {
@@ -139,29 +400,125 @@ func (r *Resolver) sendOutstandingQuestions() {
 		questions = append(questions, q)
 	}
 
-	r.netClient.sendQuestions(questions)
+	err := r.netClient.sendQuestions(questions, r.cache.getKnownAnswers(questions))
+	if err != nil {
+		log.Printf("dnssd: failed sending questions: %v", err)
+	}
+}
+
+// isOwnSource returns true if the given source is the mDNS port of one of our own addresses, i.e. a
+// message from it was sent by this host and looped back to us.
+func (r *Resolver) isOwnSource(source *net.UDPAddr) bool {
+	if source == nil || source.Port != mdnsPort {
+		return false
+	}
+
+	for _, addresses := range [][]net.IP{r.interfaceAddresses, r.localAddresses} {
+		for _, address := range addresses {
+			if address.Equal(source.IP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// observeQuery handles observing a query sent by another host, which may make our own questions redundant
+// and reveals records in the cache that are no longer answered. Queries sent from ports other than the
+// mDNS port are ignored, as they are answered with unicast responses we never see.
+func (r *Resolver) observeQuery(query query) {
+	if query.truncated || query.isLegacyUnicast() || r.isOwnSource(query.source) {
+		// More known answers follow in another packet, the answers are not sent to us, or the query was
+		// sent by us and looped back
+		return
+	}
+
+	r.onTimeElapsed()
+	r.cache.onQueryObserved(query)
+	r.suppressDuplicateQuestions(query)
+	r.scheduleUpdateTimer()
+}
+
+// suppressDuplicateQuestions handles observing a query sent by another host. If the query asks the same
+// question as one of our browse queries that is about to be sent, and all of its known answers are ones
+// we would include too, the responses it elicits will answer our question as well, so our query is
+// treated as having been sent (RFC 6762 Section 7.3).
+func (r *Resolver) suppressDuplicateQuestions(query query) {
+	now := r.clock.Now()
+
+	for _, q := range query.questions {
+		if q.unicastResponse || q.questionType != questionTypePointer {
+			// Responses to questions asking for unicast responses are not received by us
+			continue
+		}
+
+		for name, browseQuery := range r.browseQueries {
+			if !strings.EqualFold(name.String(), q.name) || browseQuery.nextQueryTime.After(now.Add(duplicateQuestionWindow)) {
+				continue
+			}
+
+			if knownAnswersCovered(query.knownAnswers, q, r.cache.getKnownAnswers([]question{q})) {
+				log.Printf("Suppressing duplicate question %v\n", q)
+				browseQuery.onQuerySent(now)
+			}
+		}
+	}
+}
+
+// knownAnswersCovered returns true if all of the given known answers that answer the question are also
+// among our own known answers.
+func knownAnswersCovered(knownAnswers []dns.RR, q question, ownKnownAnswers []dns.RR) bool {
+	for _, knownAnswer := range knownAnswers {
+		if !strings.EqualFold(knownAnswer.Header().Name, q.name) || knownAnswer.Header().Rrtype != q.toDNSQuestion().Qtype {
+			continue
+		}
+
+		if !recordsContain(ownKnownAnswers, knownAnswer) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDue returns true if the query's next question is due at the given time.
+func (q *continuousQuery) isDue(now time.Time) bool {
+	return !q.nextQueryTime.After(now)
+}
+
+// onQuerySent schedules the query's next question after the query's question was sent at the given time,
+// doubling the interval between questions up to one hour.
+func (q *continuousQuery) onQuerySent(now time.Time) {
+	q.nextQueryTime = now.Add(q.interval)
+	q.queriesSent++
+
+	q.interval *= 2
+	if q.interval > maxQueryInterval {
+		q.interval = maxQueryInterval
+	}
 }
 
-// timerCreate creates a new timer that will not fire until reset with a new duration.
-func timerCreate() *time.Timer {
-	timer := time.NewTimer(time.Hour)
+// timerCreate creates a new timer from the given clock that will not fire until reset with a new duration.
+func timerCreate(clock Clock) Timer {
+	timer := clock.NewTimer(time.Hour)
 	timerStop(timer)
 	return timer
 }
 
 // timerReset safely resets the given timer.
-func timerReset(timer *time.Timer, duration time.Duration) {
+func timerReset(timer Timer, duration time.Duration) {
 	timerStop(timer)
 	timer.Reset(duration)
 }
 
 // timerStop safely stops the given timer and ensures no values can be read from its channel
-func timerStop(timer *time.Timer) {
+func timerStop(timer Timer) {
 	if !timer.Stop() {
 		// The timer already fired, drain its channel to ensure no values can be read
 		// from it.
 		select {
-		case <-timer.C:
+		case <-timer.C():
 		default:
 		}
 	}
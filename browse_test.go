@@ -0,0 +1,160 @@
+package dnssd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type observeQueryTestCase struct {
+	cachedRecords      []pointerRecord
+	query              query
+	expectedSuppressed bool
+	expectedUnanswered int
+}
+
+func TestSuppressDuplicateQuestions(t *testing.T) {
+	testCase := observeQueryTestCase{
+		cachedRecords: []pointerRecord{newTestPointerRecord("a")},
+		query: query{
+			knownAnswers: []dns.RR{newTestPointerAnswer("a")},
+			questions:    []question{{name: "_HTTP._tcp.local.", questionType: questionTypePointer}},
+			source:       &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: mdnsPort},
+		},
+		expectedSuppressed: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestSuppressDuplicateQuestionsExtraKnownAnswer(t *testing.T) {
+	testCase := observeQueryTestCase{
+		cachedRecords: []pointerRecord{newTestPointerRecord("a")},
+		query: query{
+			knownAnswers: []dns.RR{newTestPointerAnswer("a"), newTestPointerAnswer("b")},
+			questions:    []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+			source:       &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: mdnsPort},
+		},
+		expectedSuppressed: false,
+	}
+
+	testCase.run(t)
+}
+
+func TestSuppressDuplicateQuestionsOwnQuery(t *testing.T) {
+	testCase := observeQueryTestCase{
+		cachedRecords: []pointerRecord{newTestPointerRecord("a")},
+		query: query{
+			questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+			source:    &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: mdnsPort},
+		},
+		expectedSuppressed: false,
+		expectedUnanswered: 0,
+	}
+
+	testCase.run(t)
+}
+
+func TestSuppressDuplicateQuestionsLegacyUnicast(t *testing.T) {
+	testCase := observeQueryTestCase{
+		cachedRecords: []pointerRecord{newTestPointerRecord("a")},
+		query: query{
+			questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+			source:    &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 49152},
+		},
+		expectedSuppressed: false,
+		expectedUnanswered: 0,
+	}
+
+	testCase.run(t)
+}
+
+func TestSuppressDuplicateQuestionsOtherHost(t *testing.T) {
+	// The same query as our own, but sent by another host browsing for the same service
+	testCase := observeQueryTestCase{
+		cachedRecords: []pointerRecord{newTestPointerRecord("a")},
+		query: query{
+			questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+			source:    &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: mdnsPort},
+		},
+		expectedSuppressed: true,
+		expectedUnanswered: 1,
+	}
+
+	testCase.run(t)
+}
+
+func TestSuppressDuplicateQuestionsUnicastResponse(t *testing.T) {
+	testCase := observeQueryTestCase{
+		query: query{
+			questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer, unicastResponse: true}},
+			source:    &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: mdnsPort},
+		},
+		expectedSuppressed: false,
+	}
+
+	testCase.run(t)
+}
+
+func TestUnicastFirstQuery(t *testing.T) {
+	resolver, transport := newTestResolver(t, WithUnicastFirstQuery())
+
+	resolver.BrowseService("_http._tcp.local.")
+
+	// Only the first query asks for unicast responses
+	first := <-transport.sentCh
+	assert.Equal(t, uint16(dns.ClassINET|1<<unicastResponseBit), first.msg.Question[0].Qclass)
+
+	second := <-transport.sentCh
+	assert.Equal(t, uint16(dns.ClassINET), second.msg.Question[0].Qclass)
+}
+
+func (tc *observeQueryTestCase) run(t *testing.T) {
+	now := time.Now()
+	browseQuery := &continuousQuery{
+		interval:      initialQueryInterval,
+		nextQueryTime: now,
+	}
+
+	cache := newCache()
+	for _, record := range tc.cachedRecords {
+		cache.pointerRecords[record.getID()] = record
+	}
+
+	resolver := Resolver{
+		browseQueries:      map[serviceName]*continuousQuery{"_http._tcp.local.": browseQuery},
+		cache:              cache,
+		clock:              SystemClock(),
+		interfaceAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		lastCacheUpdate:    now,
+		updateTimer:        timerCreate(SystemClock()),
+	}
+
+	resolver.observeQuery(tc.query)
+
+	assert.Equal(t, tc.expectedSuppressed, browseQuery.nextQueryTime.After(now))
+	for _, record := range tc.cachedRecords {
+		assert.Equal(t, tc.expectedUnanswered, cache.pointerRecords[record.getID()].unansweredQueries)
+	}
+}
+
+// newTestPointerRecord creates a pointer record for the instance with the given name of the HTTP service.
+func newTestPointerRecord(name string) pointerRecord {
+	return pointerRecord{
+		instanceName: serviceInstanceName(name + "._http._tcp.local."),
+		serviceName:  "_http._tcp.local.",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4500 * time.Second,
+		},
+	}
+}
+
+// newTestPointerAnswer creates a PTR record for the instance with the given name of the HTTP service.
+func newTestPointerAnswer(name string) dns.RR {
+	record := newTestPointerRecord(name)
+	return record.toDNSRecord()
+}
@@ -1,7 +1,30 @@
 package dnssd
 
 import (
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Records received with a time-to-live of zero, and records flushed by a record with the cache
+	// flush bit set, remain in the cache for this long before expiring (RFC 6762 Sections 10.1
+	// and 10.2).
+	cacheFlushDelay = time.Second
+
+	// Refresh queries for a record are sent at 80%, 85%, 90%, and 95% of its time-to-live, plus a random
+	// variation of up to 2% (RFC 6762 Section 5.2).
+	firstRefreshFraction = 0.80
+	maxRefreshAttempts   = 4
+	maxRefreshJitter     = 0.02
+	refreshFractionStep  = 0.05
+
+	// Records are flushed once this many queries from other hosts that they should have answered go
+	// unanswered for this long (RFC 6762 Section 10.5).
+	poofMinUnansweredQueries = 2
+	poofTimeout              = 10 * time.Second
 )
 
 // addressRecordID is a unique identifier for an address record.
@@ -10,10 +33,25 @@ type addressRecordID struct {
 	name    hostName
 }
 
+// genericRecordID is a unique identifier for a generic record.
+type genericRecordID struct {
+	data   string // The record's data in presentation format
+	name   string
+	rrType uint16
+}
+
+// pointerRecordID is a unique identifier for a pointer record. An instance may be pointed to by its base
+// service and by any number of its subtypes.
+type pointerRecordID struct {
+	name    serviceInstanceName
+	subtype string
+}
+
 // cache manages a cache of received resource records.
 type cache struct {
 	addressRecords map[addressRecordID]addressRecord
-	pointerRecords map[serviceInstanceName]pointerRecord
+	genericRecords map[genericRecordID]genericRecord
+	pointerRecords map[pointerRecordID]pointerRecord
 	serviceRecords map[serviceInstanceName]serviceRecord
 	textRecords    map[serviceInstanceName]textRecord
 }
@@ -24,19 +62,22 @@ type serviceInstanceID struct {
 	name    serviceInstanceName
 }
 
-type questionType int
+// questionType is the DNS type of the records a question asks for.
+type questionType uint16
 
 const (
-	questionTypeIPv4Address questionType = iota
-	questionTypeIPv6Address
-	questionTypePointer
-	questionTypeService
-	questionTypeText
+	questionTypeIPv4Address = questionType(dns.TypeA)
+	questionTypeIPv6Address = questionType(dns.TypeAAAA)
+	questionTypeAny         = questionType(dns.TypeANY)
+	questionTypePointer     = questionType(dns.TypePTR)
+	questionTypeService     = questionType(dns.TypeSRV)
+	questionTypeText        = questionType(dns.TypeTXT)
 )
 
 type question struct {
-	name         string
-	questionType questionType
+	name            string
+	questionType    questionType
+	unicastResponse bool // Whether the question asks for a unicast response (RFC 6762 Section 5.4)
 }
 
 // addressRecordsByHostName returns a mapping of address records by host name.
@@ -50,11 +91,12 @@ func addressRecordsByHostName(records map[addressRecordID]addressRecord) map[hos
 }
 
 // pointerRecordsByService returns a mapping of service names to the set of pointer records that
-// belong to the service.
-func pointerRecordsByService(records map[serviceInstanceName]pointerRecord) map[serviceName][]pointerRecord {
+// belong to the service. Subtype pointer records are mapped by their subtype service name.
+func pointerRecordsByService(records map[pointerRecordID]pointerRecord) map[serviceName][]pointerRecord {
 	byService := make(map[serviceName][]pointerRecord)
 	for _, record := range records {
-		byService[record.serviceName] = append(byService[record.serviceName], record)
+		name := record.getName()
+		byService[name] = append(byService[name], record)
 	}
 
 	return byService
@@ -64,7 +106,8 @@ func pointerRecordsByService(records map[serviceInstanceName]pointerRecord) map[
 func newCache() cache {
 	return cache{
 		addressRecords: make(map[addressRecordID]addressRecord),
-		pointerRecords: make(map[serviceInstanceName]pointerRecord),
+		genericRecords: make(map[genericRecordID]genericRecord),
+		pointerRecords: make(map[pointerRecordID]pointerRecord),
 		serviceRecords: make(map[serviceInstanceName]serviceRecord),
 		textRecords:    make(map[serviceInstanceName]textRecord),
 	}
@@ -93,79 +136,291 @@ func (a *addressRecord) getQuestion() question {
 	}
 }
 
-// getMinTimeToLive returns the minimum time-to-live for all resource records in the cache.
-func (c *cache) getMinTimeToLive() time.Duration {
-	// 75 minutes is the recommended time-to-live for mDNS records as per
-	// RFC 6762 section 10.
-	minTTL := 75 * time.Minute
+// getID returns the generic record's unique identifier.
+func (g *genericRecord) getID() genericRecordID {
+	return genericRecordID{
+		data:   strings.TrimPrefix(g.rr.String(), g.rr.Header().String()),
+		name:   g.getName(),
+		rrType: g.rr.Header().Rrtype,
+	}
+}
 
-	for _, record := range c.addressRecords {
-		if record.remainingTimeToLive < minTTL {
-			minTTL = record.remainingTimeToLive
+// getID returns the pointer record's unique identifier.
+func (p *pointerRecord) getID() pointerRecordID {
+	return pointerRecordID{
+		name:    p.instanceName,
+		subtype: p.subtype,
+	}
+}
+
+// getKnownAnswers returns the records in the cache that answer any of the given questions and still have
+// more than half of their initial time-to-live remaining. These are included in queries so responders
+// do not send answers we already know (RFC 6762 Section 7.1).
+func (c *cache) getKnownAnswers(questions []question) []dns.RR {
+	var knownAnswers []dns.RR
+
+	for _, q := range questions {
+		for _, answer := range c.getAnswers(q) {
+			if answer.isKnownAnswer() {
+				knownAnswers = append(knownAnswers, toKnownAnswer(answer.toDNSRecord()))
+			}
 		}
 	}
 
-	for _, record := range c.pointerRecords {
-		if record.remainingTimeToLive < minTTL {
-			minTTL = record.remainingTimeToLive
+	return knownAnswers
+}
+
+// getAnswers returns all records in the cache that answer the given question, including those for which a
+// goodbye has been received, converted into generic records.
+func (c *cache) getAnswers(q question) []genericRecord {
+	var answers []genericRecord
+
+	for _, address := range c.addressRecords {
+		if q.isAnsweredBy(address.name.String(), address.getQuestion().questionType) {
+			answers = append(answers, genericRecord{rr: address.toDNSRecord(), resourceRecord: address.resourceRecord})
 		}
 	}
 
-	for _, record := range c.serviceRecords {
-		if record.remainingTimeToLive < minTTL {
-			minTTL = record.remainingTimeToLive
+	for _, generic := range c.genericRecords {
+		if q.isAnsweredBy(generic.getName(), generic.getQuestionType()) {
+			answers = append(answers, generic)
+		}
+	}
+
+	for _, pointer := range c.pointerRecords {
+		if q.isAnsweredBy(pointer.getName().String(), questionTypePointer) {
+			answers = append(answers, genericRecord{rr: pointer.toDNSRecord(), resourceRecord: pointer.resourceRecord})
 		}
 	}
 
+	for _, service := range c.serviceRecords {
+		if q.isAnsweredBy(service.instanceName.String(), questionTypeService) {
+			answers = append(answers, genericRecord{rr: service.toDNSRecord(), resourceRecord: service.resourceRecord})
+		}
+	}
+
+	for _, text := range c.textRecords {
+		if q.isAnsweredBy(text.instanceName.String(), questionTypeText) {
+			answers = append(answers, genericRecord{rr: text.toDNSRecord(), resourceRecord: text.resourceRecord})
+		}
+	}
+
+	return answers
+}
+
+// getTimeUntilNextEvent returns the time until the next record in the cache expires or is flushed or, for
+// records relevant to the set of services being browsed for or answering any of the queried questions,
+// needs to be refreshed. Returns false if the cache is empty.
+func (c *cache) getTimeUntilNextEvent(browseSet map[serviceName]bool, queried []question) (time.Duration, bool) {
+	browsedInstances := c.getBrowsedInstances(browseSet)
+	browsedHosts := c.getBrowsedHosts(browseSet, browsedInstances)
+
+	var untilNextEvent time.Duration
+	found := false
+
+	onRecord := func(record resourceRecord, relevant bool) {
+		untilEvent := record.remainingTimeToLive
+		if untilRefresh, ok := record.getTimeUntilRefresh(); relevant && ok && untilRefresh < untilEvent {
+			untilEvent = untilRefresh
+		}
+
+		if untilFlush, ok := record.getTimeUntilPoofFlush(); ok && untilFlush < untilEvent {
+			untilEvent = untilFlush
+		}
+
+		if !found || untilEvent < untilNextEvent {
+			untilNextEvent = untilEvent
+			found = true
+		}
+	}
+
+	for _, record := range c.addressRecords {
+		onRecord(record.resourceRecord, browsedHosts[record.name] ||
+			answersAnyQuestion(queried, record.name.String(), record.getQuestion().questionType))
+	}
+
+	for _, record := range c.genericRecords {
+		onRecord(record.resourceRecord, answersAnyQuestion(queried, record.getName(), record.getQuestionType()))
+	}
+
+	for _, record := range c.pointerRecords {
+		onRecord(record.resourceRecord, browseSet[record.getName()] ||
+			answersAnyQuestion(queried, record.getName().String(), questionTypePointer))
+	}
+
+	for _, record := range c.serviceRecords {
+		onRecord(record.resourceRecord, browseSet[record.serviceName] || browsedInstances[record.instanceName] ||
+			answersAnyQuestion(queried, record.instanceName.String(), questionTypeService))
+	}
+
 	for _, record := range c.textRecords {
-		if record.remainingTimeToLive < minTTL {
-			minTTL = record.remainingTimeToLive
+		onRecord(record.resourceRecord, browseSet[record.serviceName] || browsedInstances[record.instanceName] ||
+			answersAnyQuestion(queried, record.instanceName.String(), questionTypeText))
+	}
+
+	return untilNextEvent, found
+}
+
+// getBrowsedHosts returns the set of hosts targeted by the service records relevant to the set of
+// services being browsed for.
+func (c *cache) getBrowsedHosts(browseSet map[serviceName]bool, browsedInstances map[serviceInstanceName]bool) map[hostName]bool {
+	hosts := make(map[hostName]bool)
+	for _, service := range c.serviceRecords {
+		if browseSet[service.serviceName] || browsedInstances[service.instanceName] {
+			hosts[service.target] = true
 		}
 	}
 
-	return minTTL
+	return hosts
 }
 
-// getQuestionsForExpiringRecords returns the set of questions for records in the cache that are close to
-// expiring and are relevant to the set of services being browsed for.
-func (c *cache) getQuestionsForExpiringRecords(browseSet map[serviceName]bool, questions map[question]bool) {
+// getBrowsedInstances returns the set of instances pointed to by the services being browsed for.
+// Instances found by browsing for one of their subtypes are included even when their base service is
+// not being browsed for.
+func (c *cache) getBrowsedInstances(browseSet map[serviceName]bool) map[serviceInstanceName]bool {
+	instances := make(map[serviceInstanceName]bool)
 	for _, pointer := range c.pointerRecords {
-		if browseSet[pointer.serviceName] && pointer.isCloseToExpiring() {
+		if browseSet[pointer.getName()] {
+			instances[pointer.instanceName] = true
+		}
+	}
+
+	return instances
+}
+
+// getCachedInstanceName returns the name under which the service instance with the given name is cached,
+// as names are compared case-insensitively (RFC 6762 Section 16). Returns the given name if none of the
+// instance's records are cached.
+func (c *cache) getCachedInstanceName(name serviceInstanceName) serviceInstanceName {
+	if _, ok := c.serviceRecords[name]; ok {
+		return name
+	}
+
+	for cachedName := range c.serviceRecords {
+		if strings.EqualFold(cachedName.String(), name.String()) {
+			return cachedName
+		}
+	}
+
+	for cachedName := range c.textRecords {
+		if strings.EqualFold(cachedName.String(), name.String()) {
+			return cachedName
+		}
+	}
+
+	return name
+}
+
+// getServiceTypes returns the set of service types discovered through service type enumeration.
+func (c *cache) getServiceTypes() map[serviceName]bool {
+	serviceTypes := make(map[serviceName]bool)
+	for _, pointer := range c.pointerRecords {
+		if pointer.serviceName == serviceTypeEnumerationName && !pointer.goodbye {
+			serviceTypes[serviceName(pointer.instanceName)] = true
+		}
+	}
+
+	return serviceTypes
+}
+
+// getQuestionsForReconfirm adds the questions for the service record of the instance with the given name
+// and the address records of its host to the given set.
+func (c *cache) getQuestionsForReconfirm(instanceName serviceInstanceName, questions map[question]bool) {
+	service, ok := c.serviceRecords[instanceName]
+	if !ok {
+		return
+	}
+
+	serviceQuestion := question{
+		name:         instanceName.String(),
+		questionType: questionTypeService,
+	}
+
+	questions[serviceQuestion] = true
+
+	for _, address := range c.addressRecords {
+		if address.name == service.target {
+			questions[address.getQuestion()] = true
+		}
+	}
+}
+
+// getQuestionsForRefresh returns the set of questions for records in the cache that are relevant to the
+// set of services being browsed for or answer any of the queried questions and are due to be refreshed,
+// recording that their refresh queries have been sent.
+func (c *cache) getQuestionsForRefresh(browseSet map[serviceName]bool, queried []question, questions map[question]bool) {
+	browsedInstances := c.getBrowsedInstances(browseSet)
+	browsedHosts := c.getBrowsedHosts(browseSet, browsedInstances)
+
+	for id, address := range c.addressRecords {
+		relevant := browsedHosts[address.name] ||
+			answersAnyQuestion(queried, address.name.String(), address.getQuestion().questionType)
+
+		if relevant && address.isRefreshDue() {
+			questions[address.getQuestion()] = true
+			address.onRefreshQuerySent()
+			c.addressRecords[id] = address
+		}
+	}
+
+	for id, generic := range c.genericRecords {
+		if answersAnyQuestion(queried, generic.getName(), generic.getQuestionType()) && generic.isRefreshDue() {
+			question := question{
+				name:         generic.getName(),
+				questionType: generic.getQuestionType(),
+			}
+
+			questions[question] = true
+			generic.onRefreshQuerySent()
+			c.genericRecords[id] = generic
+		}
+	}
+
+	for id, pointer := range c.pointerRecords {
+		relevant := browseSet[pointer.getName()] ||
+			answersAnyQuestion(queried, pointer.getName().String(), questionTypePointer)
+
+		if relevant && pointer.isRefreshDue() {
 			question := question{
-				name:         pointer.serviceName.String(),
+				name:         pointer.getName().String(),
 				questionType: questionTypePointer,
 			}
 
 			questions[question] = true
+			pointer.onRefreshQuerySent()
+			c.pointerRecords[id] = pointer
 		}
 	}
 
-	addresses := addressRecordsByHostName(c.addressRecords)
-	for _, service := range c.serviceRecords {
-		if browseSet[service.serviceName] && service.isCloseToExpiring() {
+	for id, service := range c.serviceRecords {
+		relevant := browseSet[service.serviceName] || browsedInstances[service.instanceName] ||
+			answersAnyQuestion(queried, service.instanceName.String(), questionTypeService)
+
+		if relevant && service.isRefreshDue() {
 			question := question{
 				name:         service.instanceName.String(),
 				questionType: questionTypeService,
 			}
 
 			questions[question] = true
-
-			for _, address := range addresses[service.target] {
-				if address.isCloseToExpiring() {
-					questions[address.getQuestion()] = true
-				}
-			}
+			service.onRefreshQuerySent()
+			c.serviceRecords[id] = service
 		}
 	}
 
-	for _, text := range c.textRecords {
-		if browseSet[text.serviceName] && text.isCloseToExpiring() {
+	for id, text := range c.textRecords {
+		relevant := browseSet[text.serviceName] || browsedInstances[text.instanceName] ||
+			answersAnyQuestion(queried, text.instanceName.String(), questionTypeText)
+
+		if relevant && text.isRefreshDue() {
 			question := question{
 				name:         text.instanceName.String(),
 				questionType: questionTypeText,
 			}
 
 			questions[question] = true
+			text.onRefreshQuerySent()
+			c.textRecords[id] = text
 		}
 	}
 }
@@ -177,6 +432,11 @@ func (c *cache) getQuestionsForMissingRecords(browseSet map[serviceName]bool, qu
 	pointerRecords := pointerRecordsByService(c.pointerRecords)
 
 	for serviceName := range browseSet {
+		if serviceName == serviceTypeEnumerationName {
+			// The targets of service type enumeration pointer records are service types, not instances
+			continue
+		}
+
 		pointers, ok := pointerRecords[serviceName]
 		if !ok {
 			// Do not continually ask for pointer records. We ask for pointer records when we first start
@@ -188,39 +448,45 @@ func (c *cache) getQuestionsForMissingRecords(browseSet map[serviceName]bool, qu
 		}
 
 		for _, pointer := range pointers {
-			service, ok := c.serviceRecords[pointer.instanceName]
-			if !ok {
-				question := question{
-					name:         pointer.instanceName.String(),
-					questionType: questionTypeService,
-				}
-				questions[question] = true
-			} else {
-				if _, ok := addressRecords[service.target]; !ok {
-					ipV4Question := question{
-						name:         service.target.String(),
-						questionType: questionTypeIPv4Address,
-					}
-
-					ipV6Question := question{
-						name:         service.target.String(),
-						questionType: questionTypeIPv6Address,
-					}
-
-					questions[ipV4Question] = true
-					questions[ipV6Question] = true
-				}
+			c.getQuestionsForMissingInstanceRecords(pointer.instanceName, addressRecords, questions)
+		}
+	}
+}
+
+// getQuestionsForMissingInstanceRecords returns the set of questions for records that are missing from
+// the cache which are needed to resolve the given service instance.
+func (c *cache) getQuestionsForMissingInstanceRecords(instanceName serviceInstanceName, addressRecords map[hostName][]addressRecord, questions map[question]bool) {
+	service, ok := c.serviceRecords[instanceName]
+	if !ok {
+		question := question{
+			name:         instanceName.String(),
+			questionType: questionTypeService,
+		}
+		questions[question] = true
+	} else {
+		if _, ok := addressRecords[service.target]; !ok {
+			ipV4Question := question{
+				name:         service.target.String(),
+				questionType: questionTypeIPv4Address,
 			}
 
-			if _, ok := c.textRecords[pointer.instanceName]; !ok {
-				question := question{
-					name:         pointer.instanceName.String(),
-					questionType: questionTypeText,
-				}
-				questions[question] = true
+			ipV6Question := question{
+				name:         service.target.String(),
+				questionType: questionTypeIPv6Address,
 			}
+
+			questions[ipV4Question] = true
+			questions[ipV6Question] = true
 		}
 	}
+
+	if _, ok := c.textRecords[instanceName]; !ok {
+		question := question{
+			name:         instanceName.String(),
+			questionType: questionTypeText,
+		}
+		questions[question] = true
+	}
 }
 
 // onAddressRecordReceived updates the cache with the given address record. Returns true
@@ -231,9 +497,80 @@ func (c *cache) onAddressRecordReceived(record addressRecord) bool {
 
 	existingRecord, ok := c.addressRecords[id]
 
+	if record.isGoodbye() {
+		if ok {
+			existingRecord.onGoodbye()
+			c.addressRecords[id] = existingRecord
+			cacheUpdated = true
+		}
+
+		return cacheUpdated
+	}
+
+	if record.cacheFlush {
+		for otherID, otherRecord := range c.addressRecords {
+			if otherID != id && otherRecord.name == record.name && otherRecord.isIPv4() == record.isIPv4() &&
+				otherRecord.onCacheFlush() {
+				c.addressRecords[otherID] = otherRecord
+				cacheUpdated = true
+			}
+		}
+	}
+
 	if !ok || record.cacheFlush || record.remainingTimeToLive > existingRecord.remainingTimeToLive {
+		if ok {
+			record.onReplacing(existingRecord.resourceRecord)
+		}
+
 		c.addressRecords[id] = record
 		cacheUpdated = true
+	} else {
+		// Queries for the record are still being answered
+		existingRecord.unansweredQueries = 0
+		c.addressRecords[id] = existingRecord
+	}
+
+	return cacheUpdated
+}
+
+// onGenericRecordReceived updates the cache with the given generic record. Returns true
+// if the cache was actually updated with the new record.
+func (c *cache) onGenericRecordReceived(record genericRecord) bool {
+	cacheUpdated := false
+	id := record.getID()
+
+	existingRecord, ok := c.genericRecords[id]
+
+	if record.isGoodbye() {
+		if ok {
+			existingRecord.onGoodbye()
+			c.genericRecords[id] = existingRecord
+			cacheUpdated = true
+		}
+
+		return cacheUpdated
+	}
+
+	if record.cacheFlush {
+		for otherID, otherRecord := range c.genericRecords {
+			if otherID != id && otherID.name == id.name && otherID.rrType == id.rrType && otherRecord.onCacheFlush() {
+				c.genericRecords[otherID] = otherRecord
+				cacheUpdated = true
+			}
+		}
+	}
+
+	if !ok || record.cacheFlush || record.remainingTimeToLive > existingRecord.remainingTimeToLive {
+		if ok {
+			record.onReplacing(existingRecord.resourceRecord)
+		}
+
+		c.genericRecords[id] = record
+		cacheUpdated = true
+	} else {
+		// Queries for the record are still being answered
+		existingRecord.unansweredQueries = 0
+		c.genericRecords[id] = existingRecord
 	}
 
 	return cacheUpdated
@@ -243,12 +580,40 @@ func (c *cache) onAddressRecordReceived(record addressRecord) bool {
 // if the cache was actually updated with the new record.
 func (c *cache) onPointerRecordReceived(record pointerRecord) bool {
 	cacheUpdated := false
+	id := record.getID()
+
+	existingRecord, ok := c.pointerRecords[id]
+
+	if record.isGoodbye() {
+		if ok && existingRecord.serviceName == record.serviceName {
+			existingRecord.onGoodbye()
+			c.pointerRecords[id] = existingRecord
+			cacheUpdated = true
+		}
+
+		return cacheUpdated
+	}
 
-	existingRecord, ok := c.pointerRecords[record.instanceName]
+	if record.cacheFlush {
+		for otherID, otherRecord := range c.pointerRecords {
+			if otherID != id && otherRecord.getName() == record.getName() && otherRecord.onCacheFlush() {
+				c.pointerRecords[otherID] = otherRecord
+				cacheUpdated = true
+			}
+		}
+	}
 
 	if !ok || record.cacheFlush || record.remainingTimeToLive > existingRecord.remainingTimeToLive {
-		c.pointerRecords[record.instanceName] = record
+		if ok {
+			record.onReplacing(existingRecord.resourceRecord)
+		}
+
+		c.pointerRecords[id] = record
 		cacheUpdated = true
+	} else {
+		// Queries for the record are still being answered
+		existingRecord.unansweredQueries = 0
+		c.pointerRecords[id] = existingRecord
 	}
 
 	return cacheUpdated
@@ -261,9 +626,27 @@ func (c *cache) onServiceRecordReceived(record serviceRecord) bool {
 
 	existingRecord, ok := c.serviceRecords[record.instanceName]
 
+	if record.isGoodbye() {
+		if ok {
+			existingRecord.onGoodbye()
+			c.serviceRecords[record.instanceName] = existingRecord
+			cacheUpdated = true
+		}
+
+		return cacheUpdated
+	}
+
 	if !ok || record.cacheFlush || record.remainingTimeToLive > existingRecord.remainingTimeToLive {
+		if ok {
+			record.onReplacing(existingRecord.resourceRecord)
+		}
+
 		c.serviceRecords[record.instanceName] = record
 		cacheUpdated = true
+	} else {
+		// Queries for the record are still being answered
+		existingRecord.unansweredQueries = 0
+		c.serviceRecords[record.instanceName] = existingRecord
 	}
 
 	return cacheUpdated
@@ -276,14 +659,108 @@ func (c *cache) onTextRecordReceived(record textRecord) bool {
 
 	existingRecord, ok := c.textRecords[record.instanceName]
 
+	if record.isGoodbye() {
+		if ok {
+			existingRecord.onGoodbye()
+			c.textRecords[record.instanceName] = existingRecord
+			cacheUpdated = true
+		}
+
+		return cacheUpdated
+	}
+
 	if !ok || record.cacheFlush || record.remainingTimeToLive > existingRecord.remainingTimeToLive {
+		if ok {
+			record.onReplacing(existingRecord.resourceRecord)
+		}
+
 		c.textRecords[record.instanceName] = record
 		cacheUpdated = true
+	} else {
+		// Queries for the record are still being answered
+		existingRecord.unansweredQueries = 0
+		c.textRecords[record.instanceName] = existingRecord
 	}
 
 	return cacheUpdated
 }
 
+// isReconfirming returns true if the service record of the instance with the given name is waiting to be
+// flushed unless it is received again.
+func (c *cache) isReconfirming(instanceName serviceInstanceName) bool {
+	service, ok := c.serviceRecords[instanceName]
+	return ok && service.isFlushPending()
+}
+
+// reconfirmInstance marks the service record of the instance with the given name and the address records
+// of its host to be flushed unless they are received again within ten seconds (RFC 6762 Section 10.4).
+// Returns false if the instance's service record is not in the cache.
+func (c *cache) reconfirmInstance(instanceName serviceInstanceName) bool {
+	service, ok := c.serviceRecords[instanceName]
+	if !ok || service.goodbye {
+		return false
+	}
+
+	service.reconfirm()
+	c.serviceRecords[instanceName] = service
+
+	for id, address := range c.addressRecords {
+		if address.name == service.target && !address.goodbye {
+			address.reconfirm()
+			c.addressRecords[id] = address
+		}
+	}
+
+	return true
+}
+
+// onQueryObserved handles observing a query from another host. Each cached record that is expected to
+// answer the query, as it is not among the query's known answers, counts the query as unanswered until the
+// record is received again (RFC 6762 Section 10.5).
+func (c *cache) onQueryObserved(query query) {
+	for _, q := range query.questions {
+		if q.unicastResponse {
+			// The answers may be sent directly to the querying host, so we cannot expect to see them
+			continue
+		}
+
+		for id, address := range c.addressRecords {
+			if address.isExpectedAnswer(q, address.name.String(), address.getQuestion().questionType, address.toDNSRecord(), query.knownAnswers) {
+				address.onUnansweredQuery()
+				c.addressRecords[id] = address
+			}
+		}
+
+		for id, generic := range c.genericRecords {
+			if generic.isExpectedAnswer(q, generic.getName(), generic.getQuestionType(), generic.toDNSRecord(), query.knownAnswers) {
+				generic.onUnansweredQuery()
+				c.genericRecords[id] = generic
+			}
+		}
+
+		for id, pointer := range c.pointerRecords {
+			if pointer.isExpectedAnswer(q, pointer.getName().String(), questionTypePointer, pointer.toDNSRecord(), query.knownAnswers) {
+				pointer.onUnansweredQuery()
+				c.pointerRecords[id] = pointer
+			}
+		}
+
+		for id, service := range c.serviceRecords {
+			if service.isExpectedAnswer(q, service.instanceName.String(), questionTypeService, service.toDNSRecord(), query.knownAnswers) {
+				service.onUnansweredQuery()
+				c.serviceRecords[id] = service
+			}
+		}
+
+		for id, text := range c.textRecords {
+			if text.isExpectedAnswer(q, text.instanceName.String(), questionTypeText, text.toDNSRecord(), query.knownAnswers) {
+				text.onUnansweredQuery()
+				c.textRecords[id] = text
+			}
+		}
+	}
+}
+
 // onTimeElapsed updates the cache based on the specified amount of elapsed time. Any resource
 // records whose time-to-live has expired will be evicted from the cache. Returns true if any
 // records have been evicted.
@@ -293,6 +770,7 @@ func (c *cache) onTimeElapsed(duration time.Duration) bool {
 	for id, record := range c.addressRecords {
 		record.remainingTimeToLive -= duration
 		if record.remainingTimeToLive > 0 {
+			cacheUpdated = record.checkUnansweredQueries() || cacheUpdated
 			c.addressRecords[id] = record
 		} else {
 			delete(c.addressRecords, id)
@@ -300,9 +778,21 @@ func (c *cache) onTimeElapsed(duration time.Duration) bool {
 		}
 	}
 
+	for id, record := range c.genericRecords {
+		record.remainingTimeToLive -= duration
+		if record.remainingTimeToLive > 0 {
+			cacheUpdated = record.checkUnansweredQueries() || cacheUpdated
+			c.genericRecords[id] = record
+		} else {
+			delete(c.genericRecords, id)
+			cacheUpdated = true
+		}
+	}
+
 	for id, record := range c.pointerRecords {
 		record.remainingTimeToLive -= duration
 		if record.remainingTimeToLive > 0 {
+			cacheUpdated = record.checkUnansweredQueries() || cacheUpdated
 			c.pointerRecords[id] = record
 		} else {
 			delete(c.pointerRecords, id)
@@ -313,6 +803,7 @@ func (c *cache) onTimeElapsed(duration time.Duration) bool {
 	for id, record := range c.serviceRecords {
 		record.remainingTimeToLive -= duration
 		if record.remainingTimeToLive > 0 {
+			cacheUpdated = record.checkUnansweredQueries() || cacheUpdated
 			c.serviceRecords[id] = record
 		} else {
 			delete(c.serviceRecords, id)
@@ -323,6 +814,7 @@ func (c *cache) onTimeElapsed(duration time.Duration) bool {
 	for id, record := range c.textRecords {
 		record.remainingTimeToLive -= duration
 		if record.remainingTimeToLive > 0 {
+			cacheUpdated = record.checkUnansweredQueries() || cacheUpdated
 			c.textRecords[id] = record
 		} else {
 			delete(c.textRecords, id)
@@ -333,46 +825,301 @@ func (c *cache) onTimeElapsed(duration time.Duration) bool {
 	return cacheUpdated
 }
 
-// toResolvedInstances returns the set of fully resolved service instances in the cache.
+// getRemovalReason returns why the service instance with the given name was removed, based on whether
+// any of its records remaining in the cache were flushed or had a goodbye received for them.
+func (c *cache) getRemovalReason(instanceName serviceInstanceName) RemovalReason {
+	records := []resourceRecord{
+		c.pointerRecords[pointerRecordID{name: instanceName}].resourceRecord,
+		c.textRecords[instanceName].resourceRecord,
+	}
+
+	if serviceRecord, ok := c.serviceRecords[instanceName]; ok {
+		records = append(records, serviceRecord.resourceRecord)
+
+		for _, address := range c.addressRecords {
+			if address.name == serviceRecord.target {
+				records = append(records, address.resourceRecord)
+			}
+		}
+	}
+
+	return getRemovalReason(records)
+}
+
+// getSubtypes returns the sorted subtype labels of all subtypes the service instance with the given name
+// has been found under. Returns nil if the instance has not been found under any subtype.
+func (c *cache) getSubtypes(instanceName serviceInstanceName) []string {
+	var subtypes []string
+	for id, pointer := range c.pointerRecords {
+		if id.name == instanceName && id.subtype != "" && !pointer.goodbye {
+			subtypes = append(subtypes, id.subtype)
+		}
+	}
+
+	sort.Strings(subtypes)
+	return subtypes
+}
+
+// resolveInstance returns the fully resolved service instance with the given name, with one entry
+// for each of the instance's addresses. Returns an empty list if the instance cannot be resolved
+// from the records in the cache.
+func (c *cache) resolveInstance(instanceName serviceInstanceName, addressRecords map[hostName][]addressRecord) []ServiceInstance {
+	instances := make([]ServiceInstance, 0)
+
+	serviceRecord, hasService := c.serviceRecords[instanceName]
+	if !hasService || serviceRecord.goodbye {
+		return instances
+	}
+
+	textRecord, hasText := c.textRecords[instanceName]
+	if !hasText || textRecord.goodbye {
+		return instances
+	}
+
+	subtypes := c.getSubtypes(instanceName)
+
+	for _, addressRecord := range addressRecords[serviceRecord.target] {
+		if addressRecord.goodbye {
+			continue
+		}
+
+		instance := ServiceInstance{
+			Address:        addressRecord.address,
+			InstanceName:   instanceName.String(),
+			Port:           serviceRecord.port,
+			ServiceName:    serviceRecord.serviceName.String(),
+			Subtypes:       subtypes,
+			TextRecords:    textRecord.values,
+			TextRecordsRaw: textRecord.raw,
+		}
+
+		instances = append(instances, instance)
+	}
+
+	return instances
+}
+
+// toResolvedInstances returns the set of fully resolved service instances in the cache. Instances
+// for which a goodbye has been received are not considered to be resolved.
 func (c *cache) toResolvedInstances() map[serviceInstanceID]ServiceInstance {
 	instances := make(map[serviceInstanceID]ServiceInstance)
 	addressRecords := addressRecordsByHostName(c.addressRecords)
 
-	for instanceName := range c.pointerRecords {
-		serviceRecord, hasService := c.serviceRecords[instanceName]
-		if !hasService {
+	for _, pointerRecord := range c.pointerRecords {
+		if pointerRecord.goodbye {
 			continue
 		}
 
-		textRecord, hasText := c.textRecords[instanceName]
-		if !hasText {
-			continue
+		for _, instance := range c.resolveInstance(pointerRecord.instanceName, addressRecords) {
+			instances[instance.getID()] = instance
 		}
+	}
 
-		for _, addressRecord := range addressRecords[serviceRecord.target] {
-			instance := ServiceInstance{
-				Address:      addressRecord.address,
-				InstanceName: instanceName.String(),
-				Port:         serviceRecord.port,
-				ServiceName:  serviceRecord.serviceName.String(),
-				TextRecords:  textRecord.values,
-			}
+	return instances
+}
 
-			instances[instance.getID()] = instance
+// expireSoon reduces the resource record's remaining time-to-live so that it expires from the cache
+// in one second. Returns true if the remaining time-to-live was reduced.
+func (r *resourceRecord) expireSoon() bool {
+	if r.remainingTimeToLive <= cacheFlushDelay {
+		return false
+	}
+
+	r.remainingTimeToLive = cacheFlushDelay
+	return true
+}
+
+// onCacheFlush handles receiving a record with the cache flush bit set for the same name, type, and class
+// as this record. If this record was received more than one second ago, it is set to expire in one second
+// (RFC 6762 Section 10.2). Returns true if this record was updated.
+func (r *resourceRecord) onCacheFlush() bool {
+	if r.initialTimeToLive-r.remainingTimeToLive <= cacheFlushDelay {
+		// Records received within the last second were likely received in the same packet burst as the
+		// flushing record and are retained.
+		return false
+	}
+
+	return r.expireSoon()
+}
+
+// onGoodbye handles receiving a goodbye for the resource record, setting it to expire in one second (RFC
+// 6762 Section 10.1).
+func (r *resourceRecord) onGoodbye() {
+	r.goodbye = true
+	r.expireSoon()
+}
+
+// isGoodbye returns true if the resource record was received with a time-to-live of zero, indicating that
+// the record is no longer valid (RFC 6762 Section 10.1).
+func (r *resourceRecord) isGoodbye() bool {
+	return r.remainingTimeToLive == 0
+}
+
+// checkUnansweredQueries flushes the resource record if at least two queries for it from other hosts
+// went unanswered and no answer has been seen within ten seconds of the first (RFC 6762 Section 10.5).
+// Returns true if the record was flushed.
+func (r *resourceRecord) checkUnansweredQueries() bool {
+	untilFlush, ok := r.getTimeUntilPoofFlush()
+	if !ok || untilFlush > 0 {
+		return false
+	}
+
+	r.onGoodbye()
+	r.flushed = true
+	return true
+}
+
+// onReplacing handles the resource record, received again, replacing the given cached copy. The cached
+// copy's renewals are carried over, counting one more if the record extends its remaining time-to-live.
+func (r *resourceRecord) onReplacing(cached resourceRecord) {
+	r.renewals = cached.renewals
+	if r.remainingTimeToLive > cached.remainingTimeToLive {
+		r.renewals++
+	}
+}
+
+// getTimeUntilPoofFlush returns the time until the resource record is flushed because queries for it went
+// unanswered. Returns false if the record is not due to be flushed.
+func (r *resourceRecord) getTimeUntilPoofFlush() (time.Duration, bool) {
+	if !r.isFlushPending() {
+		return 0, false
+	}
+
+	return r.remainingTimeToLive - r.poofTimeToLive, true
+}
+
+// getTimeUntilRefresh returns the time until the resource record's next refresh query is due. Returns
+// false if no more refresh queries should be sent for the record.
+func (r *resourceRecord) getTimeUntilRefresh() (time.Duration, bool) {
+	if r.goodbye || r.refreshAttempts >= maxRefreshAttempts {
+		return 0, false
+	}
+
+	elapsed := r.initialTimeToLive - r.remainingTimeToLive
+	return time.Duration(r.getRefreshFraction()*float64(r.initialTimeToLive)) - elapsed, true
+}
+
+// getRefreshFraction returns the fraction of the resource record's initial time-to-live after which its
+// next refresh query is due.
+func (r *resourceRecord) getRefreshFraction() float64 {
+	return firstRefreshFraction + float64(r.refreshAttempts)*refreshFractionStep + r.refreshJitter
+}
+
+// isExpectedAnswer returns true if the resource record, with the given name, type, and DNS representation,
+// is expected to be sent in answer to the given question of a query with the given known answers.
+func (r *resourceRecord) isExpectedAnswer(q question, name string, qType questionType, record dns.RR, knownAnswers []dns.RR) bool {
+	return !r.goodbye && q.isAnsweredBy(name, qType) && !recordInKnownAnswers(record, knownAnswers)
+}
+
+// isKnownAnswer returns true if the resource record may be included in the known-answer section of a
+// query, which requires more than half of its initial time-to-live to remain (RFC 6762 Section 7.1).
+// Records waiting to be flushed are left out so that responders answer for them if they still can.
+func (r *resourceRecord) isKnownAnswer() bool {
+	return !r.goodbye && !r.isFlushPending() && r.remainingTimeToLive > r.initialTimeToLive/2
+}
+
+// isFlushPending returns true if the resource record will be flushed unless it is received again.
+func (r *resourceRecord) isFlushPending() bool {
+	return !r.goodbye && r.unansweredQueries >= poofMinUnansweredQueries
+}
+
+// reconfirm marks the resource record to be flushed unless it is received again within ten seconds.
+func (r *resourceRecord) reconfirm() {
+	if r.unansweredQueries == 0 {
+		r.poofTimeToLive = r.remainingTimeToLive - poofTimeout
+	}
+
+	if r.unansweredQueries < poofMinUnansweredQueries {
+		r.unansweredQueries = poofMinUnansweredQueries
+	}
+}
+
+// onUnansweredQuery handles observing a query from another host that the resource record is expected to
+// answer. The first such query starts the timeout after which the record is flushed unless it is seen
+// again.
+func (r *resourceRecord) onUnansweredQuery() {
+	if r.unansweredQueries == 0 {
+		r.poofTimeToLive = r.remainingTimeToLive - poofTimeout
+	}
+
+	r.unansweredQueries++
+}
+
+// isRefreshDue returns true if the resource record's next refresh query is due.
+func (r *resourceRecord) isRefreshDue() bool {
+	untilRefresh, ok := r.getTimeUntilRefresh()
+	return ok && untilRefresh <= 0
+}
+
+// onRefreshQuerySent handles a refresh query having been sent for the resource record. Refresh queries
+// whose time has already passed are skipped rather than sent in a burst.
+func (r *resourceRecord) onRefreshQuerySent() {
+	for r.isRefreshDue() {
+		r.refreshAttempts++
+	}
+}
+
+// getRemovalReason returns why a service instance with the given records was removed. Flushing records
+// takes precedence over goodbyes as flushed records are also marked as goodbyes.
+func getRemovalReason(records []resourceRecord) RemovalReason {
+	reason := RemovalReasonExpired
+
+	for _, record := range records {
+		if record.flushed {
+			return RemovalReasonFlushed
+		}
+
+		if record.goodbye {
+			reason = RemovalReasonGoodbye
 		}
 	}
 
-	return instances
+	return reason
+}
+
+// answersAnyQuestion returns true if records with the given name and type answer any of the given
+// questions.
+func answersAnyQuestion(questions []question, name string, qType questionType) bool {
+	for i := range questions {
+		if questions[i].isAnsweredBy(name, qType) {
+			return true
+		}
+	}
+
+	return false
 }
 
-// isCloseToExpiring returns true if the resource record's time-to-live is close to expiring
-// and should be reconfirmed soon.
-func (r *resourceRecord) isCloseToExpiring() bool {
-	elapsed := (r.initialTimeToLive - r.remainingTimeToLive).Seconds()
+// isAnsweredBy returns true if the question is answered by records with the given name and type.
+func (q *question) isAnsweredBy(name string, qType questionType) bool {
+	return (q.questionType == questionTypeAny || q.questionType == qType) && strings.EqualFold(q.name, name)
+}
+
+// String converts a question type to the name of its DNS type, e.g. "PTR".
+func (t questionType) String() string {
+	return dns.Type(t).String()
+}
+
+// toKnownAnswer clears the cache flush bit of the given record, which must not be set in the known-answer
+// section of a query (RFC 6762 Section 10.2).
+func toKnownAnswer(rr dns.RR) dns.RR {
+	rr.Header().Class &^= 1 << cacheFlushBit
+	return rr
+}
+
+// isInstanceOf returns true if the service instance belongs to the service with the given name. Subtype
+// service names match instances that have been found under that subtype.
+func (s *ServiceInstance) isInstanceOf(name serviceName) bool {
+	if s.ServiceName == name.String() {
+		return true
+	}
+
+	for _, subtype := range s.Subtypes {
+		if subtype+subtypeSeparator+s.ServiceName == name.String() {
+			return true
+		}
+	}
 
-	// RFC 6762 section 10 specifies that records should be refreshed when more than 80% of
-	// their initial time-to-live has elapsed.
-	return (elapsed / r.initialTimeToLive.Seconds()) > 0.8
+	return false
 }
 
 // getID returns the service instance's unique id.
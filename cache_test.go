@@ -5,11 +5,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockCache struct {
 	addressRecords []addressRecord
+	genericRecords []genericRecord
 	pointerRecords []pointerRecord
 	serviceRecords []serviceRecord
 	textRecords    []textRecord
@@ -21,6 +23,31 @@ type addAddressRecordTestCase struct {
 	expectedRecords []addressRecord
 }
 
+type addPointerRecordTestCase struct {
+	record          pointerRecord
+	initialRecords  []pointerRecord
+	expectedRecords []pointerRecord
+}
+
+type addServiceRecordTestCase struct {
+	record          serviceRecord
+	initialRecords  []serviceRecord
+	expectedRecords []serviceRecord
+}
+
+type addTextRecordTestCase struct {
+	record          textRecord
+	initialRecords  []textRecord
+	expectedRecords []textRecord
+}
+
+type refreshTestCase struct {
+	browseSet         map[serviceName]bool
+	cache             mockCache
+	expectedAttempts  int // Refresh attempts recorded for the pointer record after the questions were asked
+	expectedQuestions map[question]bool
+}
+
 type timeElapsedTestCase struct {
 	duration           time.Duration
 	initialCache       mockCache
@@ -69,6 +96,143 @@ func TestAddAddressRecordCacheFlushSet(t *testing.T) {
 	testCase.run(t)
 }
 
+func TestAddAddressRecordCacheFlushDifferentFamily(t *testing.T) {
+	existingRecord := addressRecord{
+		address: net.ParseIP("fe03::fb"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 60 * time.Second,
+		},
+	}
+
+	newRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			cacheFlush:          true,
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 120 * time.Second,
+		},
+	}
+
+	testCase := addAddressRecordTestCase{
+		record:          newRecord,
+		initialRecords:  []addressRecord{existingRecord},
+		expectedRecords: []addressRecord{existingRecord, newRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddAddressRecordCacheFlushOtherAddress(t *testing.T) {
+	existingRecord := addressRecord{
+		address: net.ParseIP("172.16.6.197"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 60 * time.Second,
+		},
+	}
+
+	newRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			cacheFlush:          true,
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 120 * time.Second,
+		},
+	}
+
+	flushedRecord := existingRecord
+	flushedRecord.remainingTimeToLive = time.Second
+
+	testCase := addAddressRecordTestCase{
+		record:          newRecord,
+		initialRecords:  []addressRecord{existingRecord},
+		expectedRecords: []addressRecord{flushedRecord, newRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddAddressRecordCacheFlushRecentAddress(t *testing.T) {
+	// Records received within the last second are not flushed
+	existingRecord := addressRecord{
+		address: net.ParseIP("172.16.6.197"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 120*time.Second - 500*time.Millisecond,
+		},
+	}
+
+	newRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			cacheFlush:          true,
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 120 * time.Second,
+		},
+	}
+
+	testCase := addAddressRecordTestCase{
+		record:          newRecord,
+		initialRecords:  []addressRecord{existingRecord},
+		expectedRecords: []addressRecord{existingRecord, newRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddAddressRecordGoodbye(t *testing.T) {
+	existingRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 120 * time.Second,
+		},
+	}
+
+	goodbyeRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+		resourceRecord: resourceRecord{
+			cacheFlush: true,
+		},
+	}
+
+	expiringRecord := existingRecord
+	expiringRecord.remainingTimeToLive = time.Second
+	expiringRecord.goodbye = true
+
+	testCase := addAddressRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []addressRecord{existingRecord},
+		expectedRecords: []addressRecord{expiringRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddAddressRecordGoodbyeNotCached(t *testing.T) {
+	goodbyeRecord := addressRecord{
+		address: net.ParseIP("172.16.6.0"),
+		name:    "test_host",
+	}
+
+	testCase := addAddressRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []addressRecord{},
+		expectedRecords: []addressRecord{},
+	}
+
+	testCase.run(t)
+}
+
 func TestAddAddressRecordDifferentAddress(t *testing.T) {
 	existingRecord := addressRecord{
 		address: net.ParseIP("172.16.6.197"),
@@ -154,8 +318,12 @@ func TestAddAddressRecordHigherTTL(t *testing.T) {
 		existingRecord,
 	}
 
+	// The existing record is renewed by the new one
+	renewedRecord := newRecord
+	renewedRecord.renewals = 1
+
 	expectedRecords := []addressRecord{
-		newRecord,
+		renewedRecord,
 	}
 
 	testCase := addAddressRecordTestCase{
@@ -203,6 +371,452 @@ func TestAddAddressRecordLowerTTL(t *testing.T) {
 	testCase.run(t)
 }
 
+func TestAddPointerRecordCacheFlush(t *testing.T) {
+	existingRecord := pointerRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4000 * time.Second,
+		},
+	}
+
+	unrelatedRecord := pointerRecord{
+		instanceName: "test instance._another_service",
+		serviceName:  "_another_service",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4000 * time.Second,
+		},
+	}
+
+	newRecord := pointerRecord{
+		instanceName: "another test instance._test_service",
+		serviceName:  "_test_service",
+		resourceRecord: resourceRecord{
+			cacheFlush:          true,
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4500 * time.Second,
+		},
+	}
+
+	flushedRecord := existingRecord
+	flushedRecord.remainingTimeToLive = time.Second
+
+	testCase := addPointerRecordTestCase{
+		record:          newRecord,
+		initialRecords:  []pointerRecord{existingRecord, unrelatedRecord},
+		expectedRecords: []pointerRecord{flushedRecord, unrelatedRecord, newRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddPointerRecordGoodbye(t *testing.T) {
+	existingRecord := pointerRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4000 * time.Second,
+		},
+	}
+
+	goodbyeRecord := pointerRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+	}
+
+	expiringRecord := existingRecord
+	expiringRecord.remainingTimeToLive = time.Second
+	expiringRecord.goodbye = true
+
+	testCase := addPointerRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []pointerRecord{existingRecord},
+		expectedRecords: []pointerRecord{expiringRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddServiceRecordGoodbye(t *testing.T) {
+	existingRecord := serviceRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+		port:         9871,
+		target:       "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 100 * time.Second,
+		},
+	}
+
+	goodbyeRecord := existingRecord
+	goodbyeRecord.cacheFlush = true
+	goodbyeRecord.initialTimeToLive = 0
+	goodbyeRecord.remainingTimeToLive = 0
+
+	expiringRecord := existingRecord
+	expiringRecord.remainingTimeToLive = time.Second
+	expiringRecord.goodbye = true
+
+	testCase := addServiceRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []serviceRecord{existingRecord},
+		expectedRecords: []serviceRecord{expiringRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddServiceRecordGoodbyeAlreadyExpiring(t *testing.T) {
+	existingRecord := serviceRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+		port:         9871,
+		target:       "test_host",
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   120 * time.Second,
+			remainingTimeToLive: 500 * time.Millisecond,
+		},
+	}
+
+	goodbyeRecord := existingRecord
+	goodbyeRecord.initialTimeToLive = 0
+	goodbyeRecord.remainingTimeToLive = 0
+
+	expiringRecord := existingRecord
+	expiringRecord.goodbye = true
+
+	testCase := addServiceRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []serviceRecord{existingRecord},
+		expectedRecords: []serviceRecord{expiringRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestAddTextRecordGoodbye(t *testing.T) {
+	existingRecord := textRecord{
+		instanceName: "test instance._test_service",
+		serviceName:  "_test_service",
+		values: map[string]string{
+			"hello": "world",
+		},
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   4500 * time.Second,
+			remainingTimeToLive: 4500 * time.Second,
+		},
+	}
+
+	goodbyeRecord := existingRecord
+	goodbyeRecord.initialTimeToLive = 0
+	goodbyeRecord.remainingTimeToLive = 0
+
+	expiringRecord := existingRecord
+	expiringRecord.remainingTimeToLive = time.Second
+	expiringRecord.goodbye = true
+
+	testCase := addTextRecordTestCase{
+		record:          goodbyeRecord,
+		initialRecords:  []textRecord{existingRecord},
+		expectedRecords: []textRecord{expiringRecord},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetQuestionsForRefreshDue(t *testing.T) {
+	testCase := refreshTestCase{
+		browseSet: map[serviceName]bool{"_test_service": true},
+		cache: mockCache{
+			pointerRecords: []pointerRecord{
+				{
+					instanceName: "test instance._test_service",
+					serviceName:  "_test_service",
+					resourceRecord: resourceRecord{
+						initialTimeToLive:   100 * time.Second,
+						remainingTimeToLive: 13 * time.Second,
+					},
+				},
+				{
+					instanceName: "test instance._other_service",
+					serviceName:  "_other_service",
+					resourceRecord: resourceRecord{
+						initialTimeToLive:   100 * time.Second,
+						remainingTimeToLive: 13 * time.Second,
+					},
+				},
+			},
+		},
+		// The refresh queries due at 80% and 85% of the TTL are combined into a single question
+		expectedAttempts: 2,
+		expectedQuestions: map[question]bool{
+			{name: "_test_service", questionType: questionTypePointer}: true,
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetQuestionsForRefreshNotDue(t *testing.T) {
+	testCase := refreshTestCase{
+		browseSet: map[serviceName]bool{"_test_service": true},
+		cache: mockCache{
+			pointerRecords: []pointerRecord{
+				{
+					instanceName: "test instance._test_service",
+					serviceName:  "_test_service",
+					resourceRecord: resourceRecord{
+						initialTimeToLive:   100 * time.Second,
+						remainingTimeToLive: 21 * time.Second,
+					},
+				},
+			},
+		},
+		expectedAttempts:  0,
+		expectedQuestions: map[question]bool{},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetQuestionsForRefreshQueried(t *testing.T) {
+	records := mockCache{
+		genericRecords: []genericRecord{
+			newTestHostInfoRecord("printer.local.", "laser", 100*time.Second, 13*time.Second),
+			newTestHostInfoRecord("other.local.", "laser", 100*time.Second, 13*time.Second),
+		},
+	}
+
+	cache := records.toCache()
+	queried := []question{{name: "printer.local.", questionType: questionType(dns.TypeHINFO)}}
+
+	// Records answering a queried question are refreshed even if no service is being browsed for
+	untilNextEvent, ok := cache.getTimeUntilNextEvent(map[serviceName]bool{}, queried)
+	assert.True(t, ok)
+	assert.True(t, untilNextEvent <= 0)
+
+	questions := make(map[question]bool)
+	cache.getQuestionsForRefresh(map[serviceName]bool{}, queried, questions)
+
+	assert.Equal(t, map[question]bool{
+		{name: "printer.local.", questionType: questionType(dns.TypeHINFO)}: true,
+	}, questions)
+}
+
+func TestAddGenericRecordCacheFlush(t *testing.T) {
+	oldRecord := newTestHostInfoRecord("printer.local.", "laser", 120*time.Second, 100*time.Second)
+	otherName := newTestHostInfoRecord("other.local.", "laser", 120*time.Second, 100*time.Second)
+
+	records := mockCache{
+		genericRecords: []genericRecord{oldRecord, otherName},
+	}
+
+	cache := records.toCache()
+
+	newRecord := newTestHostInfoRecord("printer.local.", "inkjet", 120*time.Second, 120*time.Second)
+	newRecord.cacheFlush = true
+	assert.True(t, cache.onGenericRecordReceived(newRecord))
+
+	// Only the other record of the same name and type is flushed
+	oldRecord.remainingTimeToLive = cacheFlushDelay
+	assert.Equal(t, genericRecordsToMap([]genericRecord{oldRecord, otherName, newRecord}), cache.genericRecords)
+}
+
+func TestGetKnownAnswers(t *testing.T) {
+	records := mockCache{
+		pointerRecords: []pointerRecord{
+			{
+				instanceName: "fresh._test_service.local.",
+				serviceName:  "_test_service.local.",
+				resourceRecord: resourceRecord{
+					cacheFlush:          true,
+					initialTimeToLive:   100 * time.Second,
+					remainingTimeToLive: 60 * time.Second,
+				},
+			},
+			{
+				instanceName: "stale._test_service.local.",
+				serviceName:  "_test_service.local.",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   100 * time.Second,
+					remainingTimeToLive: 50 * time.Second,
+				},
+			},
+			{
+				instanceName: "other._other_service.local.",
+				serviceName:  "_other_service.local.",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   100 * time.Second,
+					remainingTimeToLive: 100 * time.Second,
+				},
+			},
+		},
+	}
+
+	cache := records.toCache()
+
+	knownAnswers := cache.getKnownAnswers([]question{
+		{name: "_TEST_service.local.", questionType: questionTypePointer},
+	})
+
+	// Only records with more than half their TTL remaining are known answers, without the cache flush bit
+	assert.Equal(t, []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   "_test_service.local.",
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Ptr: "fresh._test_service.local.",
+		},
+	}, knownAnswers)
+}
+
+func TestQueryObservedFlushesRecord(t *testing.T) {
+	record := newTestPointerRecord("a")
+	cache := newCache()
+	cache.pointerRecords[record.getID()] = record
+
+	unanswered := query{
+		questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+	}
+
+	cache.onQueryObserved(unanswered)
+	assert.False(t, cache.onTimeElapsed(5*time.Second))
+
+	cache.onQueryObserved(unanswered)
+	assert.False(t, cache.onTimeElapsed(4*time.Second))
+
+	// Ten seconds after the first unanswered query, the record is flushed
+	assert.True(t, cache.onTimeElapsed(time.Second))
+	assert.Equal(t, RemovalReasonFlushed, cache.getRemovalReason("a._http._tcp.local."))
+	assert.Equal(t, time.Second, cache.pointerRecords[record.getID()].remainingTimeToLive)
+}
+
+func TestQueryObservedKnownAnswer(t *testing.T) {
+	record := newTestPointerRecord("a")
+	cache := newCache()
+	cache.pointerRecords[record.getID()] = record
+
+	answered := query{
+		knownAnswers: []dns.RR{newTestPointerAnswer("a")},
+		questions:    []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+	}
+
+	cache.onQueryObserved(answered)
+	cache.onQueryObserved(answered)
+
+	assert.False(t, cache.onTimeElapsed(10*time.Second))
+	assert.Equal(t, 0, cache.pointerRecords[record.getID()].unansweredQueries)
+}
+
+func TestQueryObservedAnswerReceived(t *testing.T) {
+	record := newTestPointerRecord("a")
+	cache := newCache()
+	cache.pointerRecords[record.getID()] = record
+
+	unanswered := query{
+		questions: []question{{name: "_http._tcp.local.", questionType: questionTypePointer}},
+	}
+
+	cache.onQueryObserved(unanswered)
+	cache.onQueryObserved(unanswered)
+	cache.onPointerRecordReceived(record)
+
+	assert.False(t, cache.onTimeElapsed(10*time.Second))
+	assert.Equal(t, RemovalReasonExpired, cache.getRemovalReason("a._http._tcp.local."))
+}
+
+func TestReconfirmInstance(t *testing.T) {
+	records := mockCache{
+		addressRecords: []addressRecord{
+			{
+				address: net.ParseIP("10.0.0.1"),
+				name:    "test-host.local.",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   120 * time.Second,
+					remainingTimeToLive: 120 * time.Second,
+				},
+			},
+		},
+		serviceRecords: []serviceRecord{
+			{
+				instanceName: "test._http._tcp.local.",
+				serviceName:  "_http._tcp.local.",
+				target:       "test-host.local.",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   120 * time.Second,
+					remainingTimeToLive: 120 * time.Second,
+				},
+			},
+		},
+	}
+
+	cache := records.toCache()
+	assert.False(t, cache.reconfirmInstance("other._http._tcp.local."))
+	assert.True(t, cache.reconfirmInstance("test._http._tcp.local."))
+	assert.True(t, cache.isReconfirming("test._http._tcp.local."))
+
+	questions := make(map[question]bool)
+	cache.getQuestionsForReconfirm("test._http._tcp.local.", questions)
+	assert.Equal(t, map[question]bool{
+		{name: "test._http._tcp.local.", questionType: questionTypeService}: true,
+		{name: "test-host.local.", questionType: questionTypeIPv4Address}:   true,
+	}, questions)
+
+	// Records being reconfirmed are not sent as known answers
+	assert.Empty(t, cache.getKnownAnswers([]question{{name: "test._http._tcp.local.", questionType: questionTypeService}}))
+
+	assert.True(t, cache.onTimeElapsed(10*time.Second))
+	assert.False(t, cache.isReconfirming("test._http._tcp.local."))
+	assert.Equal(t, RemovalReasonFlushed, cache.getRemovalReason("test._http._tcp.local."))
+}
+
+func TestGetTimeUntilNextEvent(t *testing.T) {
+	records := mockCache{
+		pointerRecords: []pointerRecord{
+			{
+				instanceName: "test instance._test_service",
+				serviceName:  "_test_service",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   100 * time.Second,
+					refreshAttempts:     maxRefreshAttempts,
+					remainingTimeToLive: 30 * time.Second,
+				},
+			},
+			{
+				instanceName: "test instance._other_service",
+				serviceName:  "_other_service",
+				resourceRecord: resourceRecord{
+					initialTimeToLive:   100 * time.Second,
+					remainingTimeToLive: 40 * time.Second,
+				},
+			},
+		},
+	}
+
+	cache := records.toCache()
+
+	// Records of services not being browsed for are only tracked until they expire
+	untilNextEvent, ok := cache.getTimeUntilNextEvent(map[serviceName]bool{}, nil)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, untilNextEvent)
+
+	// The first refresh of a record being browsed for is due at 80% of its TTL
+	untilNextEvent, ok = cache.getTimeUntilNextEvent(map[serviceName]bool{"_other_service": true}, nil)
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Second, untilNextEvent)
+
+	emptyCache := newCache()
+	_, ok = emptyCache.getTimeUntilNextEvent(map[serviceName]bool{"_test_service": true}, nil)
+	assert.False(t, ok)
+}
+
 func TestTimeElapsedEvictions(t *testing.T) {
 	duration := time.Second * 300
 
@@ -596,6 +1210,87 @@ func TestToResolvedInstancesMissingTextRecord(t *testing.T) {
 	testCase.run(t)
 }
 
+func TestToResolvedInstancesSubtypes(t *testing.T) {
+	addressRecords := []addressRecord{
+		addressRecord{
+			address: net.ParseIP("172.16.6.0"),
+			name:    "test_host",
+		},
+	}
+
+	pointerRecords := []pointerRecord{
+		pointerRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+		},
+		pointerRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+			subtype:      "_scanner",
+		},
+		pointerRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+			subtype:      "_printer",
+		},
+		pointerRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+			subtype:      "_fax",
+			resourceRecord: resourceRecord{
+				goodbye:             true,
+				remainingTimeToLive: time.Second,
+			},
+		},
+	}
+
+	serviceRecords := []serviceRecord{
+		serviceRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+			port:         9871,
+			target:       "test_host",
+		},
+	}
+
+	textRecords := []textRecord{
+		textRecord{
+			instanceName: "test instance._test_service",
+			serviceName:  "_test_service",
+			values: map[string]string{
+				"hello": "world",
+			},
+		},
+	}
+
+	cache := mockCache{
+		addressRecords: addressRecords,
+		pointerRecords: pointerRecords,
+		serviceRecords: serviceRecords,
+		textRecords:    textRecords,
+	}
+
+	expectedServices := []ServiceInstance{
+		ServiceInstance{
+			Address:      net.ParseIP("172.16.6.0"),
+			InstanceName: "test instance._test_service",
+			Port:         9871,
+			ServiceName:  "_test_service",
+			Subtypes:     []string{"_printer", "_scanner"},
+			TextRecords: map[string]string{
+				"hello": "world",
+			},
+		},
+	}
+
+	testCase := toResolvedInstancesTestCase{
+		cache:             cache,
+		expectedInstances: expectedServices,
+	}
+
+	testCase.run(t)
+}
+
 func TestToResolvedInstancesMultipleAddresses(t *testing.T) {
 	addressRecords := []addressRecord{
 		addressRecord{
@@ -698,6 +1393,51 @@ func (tc *addAddressRecordTestCase) run(t *testing.T) {
 	assert.Equal(t, expected, cache.addressRecords)
 }
 
+func (tc *addPointerRecordTestCase) run(t *testing.T) {
+	cache := cache{
+		pointerRecords: pointerRecordsToMap(tc.initialRecords),
+	}
+
+	cache.onPointerRecordReceived(tc.record)
+
+	expected := pointerRecordsToMap(tc.expectedRecords)
+	assert.Equal(t, expected, cache.pointerRecords)
+}
+
+func (tc *addServiceRecordTestCase) run(t *testing.T) {
+	cache := cache{
+		serviceRecords: serviceRecordsToMap(tc.initialRecords),
+	}
+
+	cache.onServiceRecordReceived(tc.record)
+
+	expected := serviceRecordsToMap(tc.expectedRecords)
+	assert.Equal(t, expected, cache.serviceRecords)
+}
+
+func (tc *addTextRecordTestCase) run(t *testing.T) {
+	cache := cache{
+		textRecords: textRecordsToMap(tc.initialRecords),
+	}
+
+	cache.onTextRecordReceived(tc.record)
+
+	expected := textRecordsToMap(tc.expectedRecords)
+	assert.Equal(t, expected, cache.textRecords)
+}
+
+func (tc *refreshTestCase) run(t *testing.T) {
+	cache := tc.cache.toCache()
+	questions := make(map[question]bool)
+
+	cache.getQuestionsForRefresh(tc.browseSet, nil, questions)
+
+	assert.Equal(t, tc.expectedQuestions, questions)
+
+	pointer := cache.pointerRecords[tc.cache.pointerRecords[0].getID()]
+	assert.Equal(t, tc.expectedAttempts, pointer.refreshAttempts)
+}
+
 func (tc *timeElapsedTestCase) run(t *testing.T) {
 	actualCache := tc.initialCache.toCache()
 
@@ -727,10 +1467,10 @@ func addressesToMap(addresses []addressRecord) map[addressRecordID]addressRecord
 	return addrMap
 }
 
-func pointerRecordsToMap(pointers []pointerRecord) map[serviceInstanceName]pointerRecord {
-	pointerMap := make(map[serviceInstanceName]pointerRecord)
+func pointerRecordsToMap(pointers []pointerRecord) map[pointerRecordID]pointerRecord {
+	pointerMap := make(map[pointerRecordID]pointerRecord)
 	for _, record := range pointers {
-		pointerMap[record.instanceName] = record
+		pointerMap[record.getID()] = record
 	}
 
 	return pointerMap
@@ -754,6 +1494,15 @@ func serviceRecordsToMap(records []serviceRecord) map[serviceInstanceName]servic
 	return serviceMap
 }
 
+func genericRecordsToMap(records []genericRecord) map[genericRecordID]genericRecord {
+	genericMap := make(map[genericRecordID]genericRecord)
+	for _, record := range records {
+		genericMap[record.getID()] = record
+	}
+
+	return genericMap
+}
+
 func textRecordsToMap(records []textRecord) map[serviceInstanceName]textRecord {
 	textMap := make(map[serviceInstanceName]textRecord)
 	for _, record := range records {
@@ -766,8 +1515,24 @@ func textRecordsToMap(records []textRecord) map[serviceInstanceName]textRecord {
 func (m *mockCache) toCache() cache {
 	return cache{
 		addressRecords: addressesToMap(m.addressRecords),
+		genericRecords: genericRecordsToMap(m.genericRecords),
 		pointerRecords: pointerRecordsToMap(m.pointerRecords),
 		serviceRecords: serviceRecordsToMap(m.serviceRecords),
 		textRecords:    textRecordsToMap(m.textRecords),
 	}
 }
+
+// newTestHostInfoRecord creates a generic HINFO record with the given name, CPU, and time-to-live values.
+func newTestHostInfoRecord(name string, cpu string, initialTimeToLive, remainingTimeToLive time.Duration) genericRecord {
+	return genericRecord{
+		rr: &dns.HINFO{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 120},
+			Cpu: cpu,
+			Os:  "embedded",
+		},
+		resourceRecord: resourceRecord{
+			initialTimeToLive:   initialTimeToLive,
+			remainingTimeToLive: remainingTimeToLive,
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package dnssd
+
+import (
+	"time"
+)
+
+// Clock provides the current time and timers to a resolver. The system clock is used by default; tests
+// can provide a fake clock with WithClock to control the passage of time.
+type Clock interface {
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+	// NewTimer creates a new timer that sends the current time on its channel after the duration.
+	NewTimer(d time.Duration) Timer
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// Timer is a single event timer created by a Clock, behaving like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer fires.
+	C() <-chan time.Time
+	// Reset changes the timer to expire after the duration. Returns true if the timer had been active.
+	Reset(d time.Duration) bool
+	// Stop prevents the timer from firing. Returns false if the timer already expired or was stopped.
+	Stop() bool
+}
+
+// systemClock is the clock backed by the time package.
+type systemClock struct{}
+
+// systemTimer is a timer backed by a time.Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// SystemClock returns the clock backed by the system time.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// WithClock sets the clock used for all of the resolver's timing.
+func WithClock(clock Clock) ResolverOption {
+	return func(r *Resolver) {
+		r.clock = clock
+	}
+}
+
+// AfterFunc calls f in its own goroutine after the duration elapses.
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+// NewTimer creates a new timer firing after the duration.
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// Now returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// C returns the timer's channel.
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+// Reset changes the timer to expire after the duration.
+func (t systemTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+// Stop prevents the timer from firing.
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
@@ -2,6 +2,9 @@
 package dnssd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"time"
 
@@ -18,27 +21,147 @@ const (
 	AddrFamilyAll
 )
 
+// ErrResolverClosed is returned by operations that cannot complete because the resolver was closed.
+var ErrResolverClosed = errors.New("dnssd: resolver closed")
+
+// RemovalReason indicates why a service instance was removed.
+type RemovalReason int
+
+// Indicates why a service instance was removed.
+const (
+	RemovalReasonNone    RemovalReason = iota // The event is not a removal event
+	RemovalReasonExpired                      // The instance's records expired without being refreshed
+	RemovalReasonGoodbye                      // The instance announced that it is leaving the network
+	RemovalReasonFlushed                      // Queries for the instance's records went unanswered
+)
+
+// RecordEventType indicates how a record answering a query changed.
+type RecordEventType int
+
+// Indicates how a record answering a query changed.
+const (
+	RecordEventAdded   RecordEventType = iota
+	RecordEventUpdated                 // The record was received again, renewing its time-to-live
+	RecordEventRemoved
+)
+
+// ServiceEventType indicates how a service instance changed.
+type ServiceEventType int
+
+// Indicates how a service instance changed.
+const (
+	ServiceEventAdded ServiceEventType = iota
+	ServiceEventUpdated
+	ServiceEventRemoved
+)
+
+// HostAddress is an address of a host looked up with LookupHost.
+type HostAddress struct {
+	Address    net.IP
+	TimeToLive time.Duration // Remaining time-to-live of the address record
+}
+
 // Resolver browses for services on a local area network advertised via mDNS.
 type Resolver struct {
+	browseQueries          map[serviceName]*continuousQuery
 	browseSet              map[serviceName]bool // Set of services being browsed for
 	cache                  cache
+	clock                  Clock
+	closedCh               chan struct{}
+	delayedResponse        *delayedResponse // Response to queries for shared records waiting to be sent
 	getResolvedInstancesCh chan getResolvedInstancesRequest
+	getServiceTypesCh      chan chan []string
+	hostQueryCh            chan hostQueryRequest
+	interfaceAddresses     []net.IP // Addresses our own messages are sent from, if known
 	lastCacheUpdate        time.Time
+	localAddresses         []net.IP
+	lookupAddrCh           chan lookupAddrRequest
+	lookupHostCh           chan lookupHostRequest
 	messagePipeline        messagePipeline
+	missingQuestionsAsked  map[question]bool // Questions for missing records asked since the last answers
 	netClient              netClient
-	periodicUpdateTimer    *time.Timer
+	pendingAddrLookups     []lookupAddrRequest
+	pendingHostLookups     []lookupHostRequest
+	pendingHostQueries     []hostQueryRequest
+	pendingResolves        []resolveRequest
+	recordQueries          []*recordQuery
+	recordQueryCh          chan *recordQuery
+	recordQueryDoneCh      chan *recordQuery // Record queries whose context is done
+	reconfirmCh            chan serviceInstanceName
+	reconfirmations        map[serviceInstanceName]*continuousQuery // Queries reconfirming instances' records
+	registerCh             chan registerRequest
+	registrationTimer      Timer
+	registrations          map[serviceInstanceName]*registration
+	resolveCh              chan resolveRequest
+	responseTimer          Timer
 	resolvedInstances      map[serviceInstanceID]ServiceInstance
 	serviceAddCh           chan serviceName
+	serviceTypes           map[serviceName]bool // Service types discovered through service type enumeration
 	shutdownCh             chan struct{}
+	subscribeCh            chan subscribeRequest
+	subscriptions          []*subscription
+	truncatedQueries       []*truncatedQuery // Truncated queries waiting for the rest of their known answers
+	truncatedQueryTimer    Timer
+	unicastFirstQuery      bool // Whether to ask for unicast responses to the first query for a service
+	unregisterCh           chan serviceInstanceName
+	unsubscribeCh          chan (<-chan ServiceEvent)
+	updateTimer            Timer
+}
+
+// RecordEvent describes a change to the records answering a query started with QueryRecord.
+type RecordEvent struct {
+	// Record is the record with its remaining time-to-live at the time of the event. For removal events,
+	// this is the last known state of the record with a time-to-live of zero.
+	Record dns.RR
+	Reason RemovalReason // Only set for removal events
+	Type   RecordEventType
 }
 
 // ServiceInstance represents a discovered instance of a service.
 type ServiceInstance struct {
-	Address      net.IP
+	Address        net.IP
+	InstanceName   string
+	Port           uint16
+	ServiceName    string            // The base service name, even for instances found by browsing for a subtype
+	Subtypes       []string          // Labels of the subtypes the instance has been found under, e.g. "_printer"
+	TextRecords    map[string]string // Attributes by lower case key, with boolean attributes mapped to ""
+	TextRecordsRaw [][]byte          // TXT record strings as received, e.g. to tell boolean from empty attributes
+}
+
+// ServiceEvent describes a change to the resolved instances of a service. For events delivered by
+// SubscribeServiceTypes, only the Type, Reason, and ServiceName fields are set, with ServiceName
+// holding the service type that was added or removed.
+type ServiceEvent struct {
 	InstanceName string
-	Port         uint16
-	ServiceName  string
-	TextRecords  map[string]string
+	// Instances contains the resolved state of the instance, one entry per address. For removal events,
+	// this is the last known state of the instance.
+	Instances   []ServiceInstance
+	Reason      RemovalReason // Only set for removal events
+	ServiceName string
+	Type        ServiceEventType
+}
+
+// ServiceRegistration describes a service instance to advertise on the local network.
+type ServiceRegistration struct {
+	// Addresses to advertise for the host. If empty, the addresses of the resolver's interfaces
+	// are used.
+	Addresses []net.IP
+	// HostName is the name of the host providing the service, e.g. "my-host.local.". If empty, a name
+	// derived from the system's host name is used.
+	HostName string
+	// Name is the user-friendly name of the instance, e.g. "Living Room Printer".
+	Name string
+	// OnNameConflict, if set, is called whenever the instance must be renamed because another host on the
+	// network has claimed its name. It is called with the old and new user-friendly names.
+	OnNameConflict func(oldName, newName string)
+	Port           uint16
+	ServiceName    string
+	// TextRecords are the attributes published in the instance's TXT record as "key=value" strings.
+	// Registration fails if they exceed the TXT record size limits.
+	TextRecords map[string]string
+	// TextRecordsRaw, if set, are published as the instance's TXT record strings instead of TextRecords,
+	// e.g. to publish boolean attributes without '='. They may be created from a struct with MarshalTXT.
+	TextRecordsRaw [][]byte
 }
 
 // getResolvedInstancesCh contains all data to request all fully resolved service instances
@@ -49,66 +172,403 @@ type getResolvedInstancesRequest struct {
 
 // NewResolver creates a new resolver listening for mDNS messages on the specified interfaces.
 func NewResolver(addrFamily AddrFamily, interfaces []net.Interface) (resolver Resolver, err error) {
-	msgCh := make(chan dns.Msg)
+	var localAddresses []net.IP
+	localAddresses, err = interfacesGetAddresses(addrFamily, interfaces)
+	if err != nil {
+		return
+	}
 
-	var client netClient
-	client, err = newNetClient(addrFamily, interfaces, msgCh)
+	var transport Transport
+	transport, err = NewUDPTransport(addrFamily, interfaces)
 	if err != nil {
 		return
 	}
 
+	return NewResolverWithTransport(transport, WithLocalAddresses(localAddresses))
+}
+
+// NewResolverWithTransport creates a new resolver sending and receiving mDNS messages over the given
+// transport. The resolver takes ownership of the transport and closes it when the resolver is closed.
+func NewResolverWithTransport(transport Transport, options ...ResolverOption) (resolver Resolver, err error) {
 	messagePipeline := newMessagePipeline()
 
 	resolver = Resolver{
+		browseQueries:          make(map[serviceName]*continuousQuery),
 		browseSet: make(map[serviceName]bool),
 		cache:     newCache(),
+		clock:     SystemClock(),
+		closedCh:  make(chan struct{}),
 		getResolvedInstancesCh: make(chan getResolvedInstancesRequest),
+		getServiceTypesCh:      make(chan chan []string),
+		hostQueryCh:            make(chan hostQueryRequest),
+		lookupAddrCh:           make(chan lookupAddrRequest),
+		lookupHostCh:           make(chan lookupHostRequest),
 		messagePipeline:        messagePipeline,
-		netClient:              client,
+		netClient:              netClient{transport: transport},
+		recordQueryCh:          make(chan *recordQuery),
+		recordQueryDoneCh:      make(chan *recordQuery),
+		reconfirmCh:            make(chan serviceInstanceName),
+		reconfirmations:        make(map[serviceInstanceName]*continuousQuery),
+		registerCh:             make(chan registerRequest),
+		registrations:          make(map[serviceInstanceName]*registration),
+		resolveCh:              make(chan resolveRequest),
 		resolvedInstances:      make(map[serviceInstanceID]ServiceInstance),
 		serviceAddCh:           make(chan serviceName),
+		serviceTypes:           make(map[serviceName]bool),
 		shutdownCh:             make(chan struct{}),
+		subscribeCh:            make(chan subscribeRequest),
+		unregisterCh:           make(chan serviceInstanceName),
+		unsubscribeCh:          make(chan (<-chan ServiceEvent)),
+	}
+
+	if addressed, ok := transport.(AddressedTransport); ok {
+		resolver.interfaceAddresses = addressed.Addresses()
+	}
+
+	for _, option := range options {
+		option(&resolver)
 	}
 
-	go messagePipeline.pipeMessages(msgCh)
+	resolver.lastCacheUpdate = resolver.clock.Now()
+	resolver.registrationTimer = timerCreate(resolver.clock)
+	resolver.responseTimer = timerCreate(resolver.clock)
+	resolver.truncatedQueryTimer = timerCreate(resolver.clock)
+	resolver.updateTimer = timerCreate(resolver.clock)
+
+	go messagePipeline.pipeMessages(transport.Receive())
 	go resolver.browse()
 
 	return
 }
 
 // BrowseService adds the given service to the set of services the resolver is browsing for. This has
-// no effect if the resolver is already browsing for the service.
+// no effect if the resolver is already browsing for the service. The name may also refer to a subtype
+// of a service, e.g. "_printer._sub._http._tcp.local.", to browse only for instances of that subtype.
 func (r *Resolver) BrowseService(name string) {
-	r.serviceAddCh <- serviceName(name)
+	select {
+	case r.serviceAddCh <- serviceName(name):
+	case <-r.closedCh:
+	}
+}
+
+// BrowseServiceTypes starts discovering all types of services advertised on the local network using
+// service type enumeration (RFC 6763 Section 9). Discovered types can be retrieved with GetServiceTypes
+// and browsed for with BrowseService.
+func (r *Resolver) BrowseServiceTypes() {
+	select {
+	case r.serviceAddCh <- serviceTypeEnumerationName:
+	case <-r.closedCh:
+	}
 }
 
-// Close closes the resolver and cleans up all resources owned by it.
+// Close closes the resolver and cleans up all resources owned by it. Goodbye packets are sent for all
+// registered service instances before Close returns. Once closed, the resolver's methods return
+// immediately without results, with ErrResolverClosed for those that return an error.
 func (r *Resolver) Close() {
-	go func() {
-		r.shutdownCh <- struct{}{}
-	}()
+	select {
+	case r.shutdownCh <- struct{}{}:
+	case <-r.closedCh:
+	}
+
+	<-r.closedCh
 }
 
 // GetAllResolvedInstances returns all fully resolved instances of all services being
 // browsed for.
 func (r *Resolver) GetAllResolvedInstances() []ServiceInstance {
-	responseCh := make(chan []ServiceInstance)
-	r.getResolvedInstancesCh <- getResolvedInstancesRequest{responseCh: responseCh}
+	responseCh := make(chan []ServiceInstance, 1)
 
-	instances := <-responseCh
-	return instances
+	select {
+	case r.getResolvedInstancesCh <- getResolvedInstancesRequest{responseCh: responseCh}:
+	case <-r.closedCh:
+		return nil
+	}
+
+	return <-responseCh
 }
 
-// GetResolvedInstances returns all fully resolved instances for the specified service.
-func (r *Resolver) GetResolvedInstances(serviceName string) []ServiceInstance {
+// GetServiceTypes returns the names of all service types discovered since BrowseServiceTypes was
+// called, e.g. "_http._tcp.local.".
+func (r *Resolver) GetServiceTypes() []string {
+	responseCh := make(chan []string, 1)
+
+	select {
+	case r.getServiceTypesCh <- responseCh:
+	case <-r.closedCh:
+		return nil
+	}
+
+	return <-responseCh
+}
+
+// GetResolvedInstances returns all fully resolved instances for the specified service. If a subtype
+// service name is given, only instances found under that subtype are returned.
+func (r *Resolver) GetResolvedInstances(name string) []ServiceInstance {
 	allInstances := r.GetAllResolvedInstances()
 	filteredInstances := make([]ServiceInstance, 0, len(allInstances))
 
 	for _, instance := range allInstances {
-		if instance.ServiceName == serviceName {
+		if instance.isInstanceOf(serviceName(name)) {
 			filteredInstances = append(filteredInstances, instance)
 		}
 	}
 
 	return filteredInstances
 }
+
+// RegisterService advertises the given service instance on the local network, answering queries from
+// other hosts for its records. This blocks while the resolver probes the network to ensure the instance's
+// name is unique, automatically renaming the instance if its name is already taken (RFC 6762 Section 8).
+// Returns the full name under which the instance was registered.
+func (r *Resolver) RegisterService(service ServiceRegistration) (string, error) {
+	request := registerRequest{
+		registration: service,
+		responseCh:   make(chan registerResponse, 1),
+	}
+
+	select {
+	case r.registerCh <- request:
+	case <-r.closedCh:
+		return "", ErrResolverClosed
+	}
+
+	response := <-request.responseCh
+	if response.err != nil {
+		return "", response.err
+	}
+
+	return response.instanceName.String(), nil
+}
+
+// LookupAddr looks up the host names of the given address, e.g. "printer.local.", using reverse mapping
+// PTR queries in the "in-addr.arpa." or "ip6.arpa." domain. Returns as soon as any host name is known,
+// answering from the cache if possible, or returns the context's error if it is done first.
+func (r *Resolver) LookupAddr(ctx context.Context, address net.IP) ([]string, error) {
+	reverseName, err := dns.ReverseAddr(address.String())
+	if err != nil {
+		return nil, fmt.Errorf("dnssd: invalid address %v", address)
+	}
+
+	request := lookupAddrRequest{
+		ctx:         ctx,
+		query:       &continuousQuery{interval: initialQueryInterval},
+		responseCh:  make(chan []string, 1),
+		reverseName: reverseName,
+	}
+
+	select {
+	case r.lookupAddrCh <- request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+
+	select {
+	case names := <-request.responseCh:
+		return names, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+}
+
+// LookupHost looks up the IPv4 and IPv6 addresses of the host with the given name, e.g. "printer.local.",
+// along with the time for which each address remains valid. Returns as soon as any of the host's
+// addresses are known, answering from the cache if possible, or returns the context's error if it is done
+// first. The name may omit the trailing dot.
+func (r *Resolver) LookupHost(ctx context.Context, name string) ([]HostAddress, error) {
+	request := lookupHostRequest{
+		ctx:        ctx,
+		hostName:   hostName(dns.Fqdn(name)),
+		query:      &continuousQuery{interval: initialQueryInterval},
+		responseCh: make(chan []HostAddress, 1),
+	}
+
+	select {
+	case r.lookupHostCh <- request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+
+	select {
+	case addresses := <-request.responseCh:
+		return addresses, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+}
+
+// QueryHost sends the given question directly to the mDNS port of the host with the given address rather
+// than to the multicast group, e.g. to reach a host on a routed network segment that multicast does not
+// propagate to (RFC 6762 Section 5.5). Answers are added to the resolver's cache like all others. Returns
+// once the host has answered the question, or returns the context's error if it is done first.
+func (r *Resolver) QueryHost(ctx context.Context, address net.IP, q dns.Question) error {
+	hostQuestion, ok := dnsQuestionToQuestion(&q)
+	if !ok {
+		return fmt.Errorf("dnssd: unsupported question class %v", dns.Class(q.Qclass))
+	}
+
+	request := hostQueryRequest{
+		address:    address,
+		ctx:        ctx,
+		question:   hostQuestion,
+		responseCh: make(chan error, 1),
+	}
+
+	select {
+	case r.hostQueryCh <- request:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.closedCh:
+		return ErrResolverClosed
+	}
+
+	select {
+	case err := <-request.responseCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.closedCh:
+		return ErrResolverClosed
+	}
+}
+
+// QueryRecord continuously queries for the records of the given type with the given name, e.g. the HINFO
+// record of "printer.local.", and returns a channel on which events are delivered whenever such a record
+// is added, received again, or removed once its time-to-live expires or a goodbye is received for it.
+// Events for all matching records that are already cached are delivered immediately. The name may omit the
+// trailing dot. The query stops and the channel is closed when the context is done or when the resolver is
+// closed.
+func (r *Resolver) QueryRecord(ctx context.Context, name string, rrType uint16) (<-chan RecordEvent, error) {
+	if rrType == dns.TypeNone || rrType == dns.TypeOPT {
+		return nil, fmt.Errorf("dnssd: unsupported record type %v", dns.Type(rrType))
+	}
+
+	q := newRecordQuery(ctx, question{
+		name:         dns.Fqdn(name),
+		questionType: questionType(rrType),
+	}, r.recordQueryDoneCh)
+
+	select {
+	case r.recordQueryCh <- q:
+		return q.outCh, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+}
+
+// ReconfirmInstance asks the resolver to verify that the service instance with the given full name is
+// still present, e.g. after failing to connect to it. The instance's records are queried for again and,
+// unless they are received within about ten seconds, flushed from the cache so that subscribers are sent
+// a removal event (RFC 6762 Section 10.4). The name is interpreted as for ResolveInstance. This has no
+// effect if the instance is not known.
+func (r *Resolver) ReconfirmInstance(instanceName string) {
+	name, err := toServiceInstanceName(instanceName)
+	if err != nil {
+		// Invalid names cannot match any instance and are passed on unchanged
+		name = serviceInstanceName(instanceName)
+	}
+
+	select {
+	case r.reconfirmCh <- name:
+	case <-r.closedCh:
+	}
+}
+
+// ResolveInstance resolves the service instance with the given full name, e.g.
+// "Living Room._http._tcp.local.", without browsing for all instances of its service. The name may be
+// given in presentation format or with the instance portion unescaped and is compared case-insensitively.
+// Returns as soon as the instance's address, port, and text records are known, with one entry for each
+// of the instance's addresses, or returns the context's error if it is done first.
+func (r *Resolver) ResolveInstance(ctx context.Context, instanceName string) ([]ServiceInstance, error) {
+	name, err := toServiceInstanceName(instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	request := resolveRequest{
+		askedQuestions: make(map[question]bool),
+		ctx:            ctx,
+		instanceName:   name,
+		query:          &continuousQuery{interval: initialQueryInterval},
+		responseCh:     make(chan []ServiceInstance, 1),
+	}
+
+	select {
+	case r.resolveCh <- request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+
+	select {
+	case instances := <-request.responseCh:
+		return instances, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closedCh:
+		return nil, ErrResolverClosed
+	}
+}
+
+// Subscribe starts browsing for the given service and returns a channel on which events are delivered
+// whenever an instance of the service is added, updated, or removed. Events for all instances that are
+// already resolved are delivered immediately. The channel is closed when Unsubscribe is called with it
+// or when the resolver is closed.
+func (r *Resolver) Subscribe(name string) <-chan ServiceEvent {
+	request := subscribeRequest{
+		responseCh:  make(chan (<-chan ServiceEvent), 1),
+		serviceName: serviceName(name),
+	}
+
+	select {
+	case r.subscribeCh <- request:
+	case <-r.closedCh:
+		closed := make(chan ServiceEvent)
+		close(closed)
+		return closed
+	}
+
+	return <-request.responseCh
+}
+
+// SubscribeServiceTypes starts discovering all types of services advertised on the local network and
+// returns a channel on which events are delivered whenever a service type is added or removed. Events
+// for all service types that are already known are delivered immediately. The channel is closed when
+// Unsubscribe is called with it or when the resolver is closed.
+func (r *Resolver) SubscribeServiceTypes() <-chan ServiceEvent {
+	return r.Subscribe(serviceTypeEnumerationName.String())
+}
+
+// Unsubscribe stops delivering events on the given channel returned by Subscribe and closes it. Any
+// undelivered events are discarded.
+func (r *Resolver) Unsubscribe(ch <-chan ServiceEvent) {
+	select {
+	case r.unsubscribeCh <- ch:
+	case <-r.closedCh:
+	}
+}
+
+// UnregisterService stops advertising the service instance with the given full instance name, which is
+// interpreted as for ResolveInstance. This has no effect if the instance is not registered.
+func (r *Resolver) UnregisterService(instanceName string) {
+	name, err := toServiceInstanceName(instanceName)
+	if err != nil {
+		// Invalid names cannot match any instance and are passed on unchanged
+		name = serviceInstanceName(instanceName)
+	}
+
+	select {
+	case r.unregisterCh <- name:
+	case <-r.closedCh:
+	}
+}
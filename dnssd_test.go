@@ -0,0 +1,47 @@
+package dnssd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverMethodsAfterClose(t *testing.T) {
+	resolver, _ := newTestResolver(t)
+	resolver.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		resolver.BrowseService("_http._tcp.local.")
+		resolver.BrowseServiceTypes()
+		resolver.ReconfirmInstance("Printer._ipp._tcp.local.")
+		resolver.UnregisterService("Printer._ipp._tcp.local.")
+
+		assert.Empty(t, resolver.GetAllResolvedInstances())
+		assert.Empty(t, resolver.GetServiceTypes())
+
+		_, err := resolver.RegisterService(ServiceRegistration{
+			Addresses:   []net.IP{net.IPv4(192, 168, 1, 2)},
+			HostName:    "host.local.",
+			Name:        "Printer",
+			Port:        631,
+			ServiceName: "_ipp._tcp.local.",
+		})
+		assert.ErrorIs(t, err, ErrResolverClosed)
+
+		ch := resolver.Subscribe("_http._tcp.local.")
+		_, ok := <-ch
+		assert.False(t, ok, "subscription channel should be closed")
+		resolver.Unsubscribe(ch)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("resolver methods blocked after Close")
+	}
+}
@@ -0,0 +1,147 @@
+package dnssdtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gatkin/dnssd"
+)
+
+// FakeClock is a dnssd.Clock whose time only moves when advanced explicitly, allowing timing dependent
+// behavior such as record expiry to be tested without sleeping.
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // Active timers in the order they were started
+}
+
+// fakeTimer is a timer created by a fake clock.
+type fakeTimer struct {
+	c        chan time.Time
+	clock    *FakeClock
+	deadline time.Time
+	f        func() // Function to call when the timer fires instead of sending on c
+}
+
+// NewFakeClock creates a new fake clock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+// Advance moves the clock forward by the given duration, firing all timers that expire in the meantime in
+// order of their deadlines. Functions passed to AfterFunc are called synchronously.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+
+	for {
+		timer := c.nextExpiredTimer(end)
+		if timer == nil {
+			break
+		}
+
+		if timer.deadline.After(c.now) {
+			c.now = timer.deadline
+		}
+
+		c.removeTimer(timer)
+
+		if timer.f != nil {
+			c.mutex.Unlock()
+			timer.f()
+			c.mutex.Lock()
+			continue
+		}
+
+		select {
+		case timer.c <- c.now:
+		default:
+		}
+	}
+
+	c.now = end
+	c.mutex.Unlock()
+}
+
+// AfterFunc calls f once the clock has been advanced by the given duration.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) dnssd.Timer {
+	t := &fakeTimer{
+		clock: c,
+		f:     f,
+	}
+
+	t.Reset(d)
+	return t
+}
+
+// NewTimer creates a new timer that fires once the clock has been advanced by the given duration.
+func (c *FakeClock) NewTimer(d time.Duration) dnssd.Timer {
+	t := &fakeTimer{
+		c:     make(chan time.Time, 1),
+		clock: c,
+	}
+
+	t.Reset(d)
+	return t
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// nextExpiredTimer returns the active timer with the earliest deadline that is not after the given time,
+// or nil if there is none. Must be called with the mutex held.
+func (c *FakeClock) nextExpiredTimer(end time.Time) *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if !t.deadline.After(end) && (next == nil || t.deadline.Before(next.deadline)) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+// removeTimer deactivates the given timer. Returns true if the timer was active. Must be called with the
+// mutex held.
+func (c *FakeClock) removeTimer(timer *fakeTimer) bool {
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// C returns the timer's channel.
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Reset changes the timer to expire once the clock has been advanced by the given duration.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.clock.removeTimer(t)
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+
+	return active
+}
+
+// Stop prevents the timer from firing.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	return t.clock.removeTimer(t)
+}
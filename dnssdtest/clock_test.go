@@ -0,0 +1,54 @@
+package dnssdtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testStartTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+
+	calls := 0
+	clock.AfterFunc(time.Second, func() {
+		calls++
+	})
+
+	clock.Advance(999 * time.Millisecond)
+	assert.Equal(t, 0, calls)
+
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, 1, calls)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	timer := clock.NewTimer(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Len(t, timer.C(), 0)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, testStartTime.Add(time.Second), <-timer.C())
+	assert.Equal(t, testStartTime.Add(1500*time.Millisecond), clock.Now())
+	assert.False(t, timer.Stop())
+}
+
+func TestFakeClockTimerStopped(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	timer := clock.NewTimer(time.Second)
+
+	assert.True(t, timer.Stop())
+	clock.Advance(time.Hour)
+	assert.Len(t, timer.C(), 0)
+
+	assert.False(t, timer.Reset(time.Second))
+	clock.Advance(time.Second)
+	assert.Len(t, timer.C(), 1)
+}
@@ -0,0 +1,306 @@
+// Package dnssdtest provides a simulated multicast network on which resolvers can be tested end-to-end
+// without real sockets.
+package dnssdtest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gatkin/dnssd"
+	"github.com/miekg/dns"
+)
+
+const mdnsPort = 5353
+
+// Config describes the conditions of a simulated network. The zero value is a perfect network that
+// delivers every message exactly once without delay.
+type Config struct {
+	Clock      dnssd.Clock   // Clock timing message delivery, the system clock if nil
+	Delay      time.Duration // Delay before each message is delivered
+	Duplicate  float64       // Probability that a delivered message is delivered a second time
+	Jitter     time.Duration // Maximum random delay added to each delivery, reordering messages
+	Loss       float64       // Probability that a message is not delivered to a receiving interface
+	NoLoopback bool          // Whether multicast messages are not delivered back to the sending host
+	Seed       int64         // Seed for the random decisions made by the network
+}
+
+// Host is a simulated host attached to one or more networks. It implements dnssd.AddressedTransport, so a
+// resolver is created on it with dnssd.NewResolverWithTransport.
+type Host struct {
+	clock      dnssd.Clock
+	closeOnce  sync.Once
+	closedCh   chan struct{}
+	inboxCh    chan delivery // Messages sent to the host that are not yet due
+	interfaces []Interface
+	msgCh      chan dnssd.ReceivedMessage
+}
+
+var _ dnssd.AddressedTransport = (*Host)(nil)
+
+// delivery is a message in flight to a host.
+type delivery struct {
+	due time.Time
+	msg dnssd.ReceivedMessage
+}
+
+// Interface attaches a host to a network under the given address.
+type Interface struct {
+	IP      net.IP
+	Network *Network
+}
+
+// Network is a simulated network segment, such as a LAN, on which all attached hosts receive each other's
+// multicast messages.
+type Network struct {
+	config  Config
+	members []member
+	mutex   sync.Mutex
+	random  *rand.Rand
+}
+
+// member is an interface of a host attached to a network.
+type member struct {
+	host           *Host
+	interfaceIndex int
+	ip             net.IP
+}
+
+// NewHost creates a new host attached to each of the given networks. The interface index reported for
+// received messages is the position of the interface in the list, starting at one. The host uses the
+// clock of its first network.
+func NewHost(interfaces ...Interface) *Host {
+	clock := dnssd.SystemClock()
+	if len(interfaces) > 0 {
+		clock = interfaces[0].Network.config.Clock
+	}
+
+	h := &Host{
+		clock:      clock,
+		closedCh:   make(chan struct{}),
+		inboxCh:    make(chan delivery),
+		interfaces: interfaces,
+		msgCh:      make(chan dnssd.ReceivedMessage),
+	}
+
+	go h.receive()
+
+	for i, ifi := range interfaces {
+		ifi.Network.attach(member{
+			host:           h,
+			interfaceIndex: i + 1,
+			ip:             ifi.IP,
+		})
+	}
+
+	return h
+}
+
+// NewNetwork creates a new simulated network with the given conditions.
+func NewNetwork(config Config) *Network {
+	if config.Clock == nil {
+		config.Clock = dnssd.SystemClock()
+	}
+
+	return &Network{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// Addresses returns the addresses of all of the host's interfaces.
+func (h *Host) Addresses() []net.IP {
+	addresses := make([]net.IP, 0, len(h.interfaces))
+	for _, ifi := range h.interfaces {
+		addresses = append(addresses, ifi.IP)
+	}
+
+	return addresses
+}
+
+// Close detaches the host from all networks. Messages that are still in flight to the host are dropped.
+func (h *Host) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.closedCh)
+
+		for _, ifi := range h.interfaces {
+			ifi.Network.detach(h)
+		}
+	})
+
+	return nil
+}
+
+// Receive returns the channel on which messages received on any of the host's interfaces are delivered.
+func (h *Host) Receive() <-chan dnssd.ReceivedMessage {
+	return h.msgCh
+}
+
+// receive delivers messages sent to the host once they are due, in order of their due time. Messages
+// with the same due time are delivered in the order they were sent.
+func (h *Host) receive() {
+	timer := h.clock.NewTimer(time.Hour)
+	timer.Stop()
+
+	queue := make([]delivery, 0)
+	for {
+		var msgCh chan dnssd.ReceivedMessage
+		var next dnssd.ReceivedMessage
+		if len(queue) > 0 {
+			wait := queue[0].due.Sub(h.clock.Now())
+			if wait <= 0 {
+				msgCh = h.msgCh
+				next = queue[0].msg
+			} else {
+				timer.Reset(wait)
+			}
+		}
+
+		select {
+		case <-h.closedCh:
+			return
+
+		case d := <-h.inboxCh:
+			i := sort.Search(len(queue), func(i int) bool {
+				return queue[i].due.After(d.due)
+			})
+
+			queue = append(queue, delivery{})
+			copy(queue[i+1:], queue[i:])
+			queue[i] = d
+
+		case msgCh <- next:
+			queue = queue[1:]
+
+		case <-timer.C():
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}
+}
+
+// Send sends the given message from the mDNS port of all of the host's interfaces to the given address, or
+// multicasts it if the address is nil.
+func (h *Host) Send(msg *dns.Msg, dst *net.UDPAddr) error {
+	select {
+	case <-h.closedCh:
+		return fmt.Errorf("dnssdtest: host is closed")
+	default:
+	}
+
+	data, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	for _, ifi := range h.interfaces {
+		source := &net.UDPAddr{
+			IP:   ifi.IP,
+			Port: mdnsPort,
+		}
+
+		ifi.Network.send(h, data, source, dst)
+	}
+
+	return nil
+}
+
+// NewHost creates a new host attached only to this network under the given address.
+func (n *Network) NewHost(ip net.IP) *Host {
+	return NewHost(Interface{
+		IP:      ip,
+		Network: n,
+	})
+}
+
+// attach attaches the given member to the network.
+func (n *Network) attach(m member) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.members = append(n.members, m)
+}
+
+// deliver delivers the given packet to the given member after the given delay. The packet is dropped if
+// the member's host is closed before it is delivered.
+func (n *Network) deliver(m member, data []byte, source *net.UDPAddr, delay time.Duration) {
+	// Each receiver unpacks its own copy of the message, as it would from the wire
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return
+	}
+
+	d := delivery{
+		due: n.config.Clock.Now().Add(delay),
+		msg: dnssd.ReceivedMessage{
+			InterfaceIndex: m.interfaceIndex,
+			Msg:            msg,
+			Source:         source,
+		},
+	}
+
+	select {
+	case m.host.inboxCh <- d:
+	case <-m.host.closedCh:
+	}
+}
+
+// detach removes all interfaces of the given host from the network.
+func (n *Network) detach(h *Host) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	members := n.members[:0]
+	for _, m := range n.members {
+		if m.host != h {
+			members = append(members, m)
+		}
+	}
+
+	n.members = members
+}
+
+// send delivers the given packet from the given host to all receivers on the network, subject to the
+// network's conditions. A nil destination multicasts the packet to all members.
+func (n *Network) send(sender *Host, data []byte, source, dst *net.UDPAddr) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, m := range n.members {
+		if dst == nil && m.host == sender && n.config.NoLoopback {
+			continue
+		}
+
+		if dst != nil && !dst.IP.Equal(m.ip) {
+			continue
+		}
+
+		if n.random.Float64() < n.config.Loss {
+			continue
+		}
+
+		n.deliver(m, data, source, n.getDelay())
+
+		if n.random.Float64() < n.config.Duplicate {
+			n.deliver(m, data, source, n.getDelay())
+		}
+	}
+}
+
+// getDelay returns the delay for delivering a single message. Must be called with the mutex held.
+func (n *Network) getDelay() time.Duration {
+	delay := n.config.Delay
+	if n.config.Jitter > 0 {
+		delay += time.Duration(n.random.Int63n(int64(n.config.Jitter)))
+	}
+
+	return delay
+}
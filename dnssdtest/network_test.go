@@ -0,0 +1,209 @@
+package dnssdtest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gatkin/dnssd"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const receiveTimeout = 100 * time.Millisecond
+
+type networkTestCase struct {
+	config           Config
+	dst              *net.UDPAddr
+	expectedReceived int
+}
+
+func TestNetworkDuplicate(t *testing.T) {
+	testCase := networkTestCase{
+		config: Config{
+			Duplicate:  1,
+			NoLoopback: true,
+		},
+		expectedReceived: 2,
+	}
+
+	testCase.run(t)
+}
+
+func TestNetworkLoss(t *testing.T) {
+	testCase := networkTestCase{
+		config: Config{
+			Loss: 1,
+		},
+		expectedReceived: 0,
+	}
+
+	testCase.run(t)
+}
+
+func TestNetworkMulticast(t *testing.T) {
+	testCase := networkTestCase{
+		config: Config{
+			Delay:      10 * time.Millisecond,
+			NoLoopback: true,
+		},
+		expectedReceived: 1,
+	}
+
+	testCase.run(t)
+}
+
+func TestNetworkUnicastOtherHost(t *testing.T) {
+	testCase := networkTestCase{
+		dst: &net.UDPAddr{
+			IP:   net.ParseIP("10.0.0.3"),
+			Port: mdnsPort,
+		},
+		expectedReceived: 0,
+	}
+
+	testCase.run(t)
+}
+
+func TestNetworkPreservesOrder(t *testing.T) {
+	network := NewNetwork(Config{NoLoopback: true})
+	sender := network.NewHost(net.ParseIP("10.0.0.1"))
+	receiver := network.NewHost(net.ParseIP("10.0.0.2"))
+	defer sender.Close()
+	defer receiver.Close()
+
+	for id := uint16(0); id < 10; id++ {
+		msg := new(dns.Msg)
+		msg.Id = id
+		assert.NoError(t, sender.Send(msg, nil))
+	}
+
+	for id := uint16(0); id < 10; id++ {
+		received := <-receiver.Receive()
+		assert.Equal(t, id, received.Msg.Id)
+	}
+}
+
+func TestResolverDiscoversRegisteredService(t *testing.T) {
+	network := NewNetwork(Config{
+		Delay:  time.Millisecond,
+		Jitter: 5 * time.Millisecond,
+	})
+
+	advertiserHost := network.NewHost(net.ParseIP("10.0.0.1"))
+	advertiser, err := dnssd.NewResolverWithTransport(advertiserHost, dnssd.WithLocalAddresses(advertiserHost.Addresses()))
+	assert.NoError(t, err)
+	defer advertiser.Close()
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	instanceName, err := advertiser.RegisterService(dnssd.ServiceRegistration{
+		HostName:    "advertiser.local.",
+		Name:        "Living Room",
+		Port:        8080,
+		ServiceName: "_http._tcp.local.",
+		TextRecords: map[string]string{"path": "/"},
+	})
+	assert.NoError(t, err)
+
+	events := browser.Subscribe("_http._tcp.local.")
+
+	select {
+	case event := <-events:
+		assert.Equal(t, dnssd.ServiceEventAdded, event.Type)
+		assert.Equal(t, instanceName, event.InstanceName)
+		assert.Equal(t, []dnssd.ServiceInstance{
+			{
+				Address:        net.ParseIP("10.0.0.1").To4(),
+				InstanceName:   instanceName,
+				Port:           8080,
+				ServiceName:    "_http._tcp.local.",
+				TextRecords:    map[string]string{"path": "/"},
+				TextRecordsRaw: [][]byte{[]byte("path=/")},
+			},
+		}, event.Instances)
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("service instance was not discovered")
+	}
+}
+
+func TestResolverAnswersBrowserWithMulticast(t *testing.T) {
+	network := NewNetwork(Config{})
+
+	advertiserHost := network.NewHost(net.ParseIP("10.0.0.1"))
+	advertiser, err := dnssd.NewResolverWithTransport(advertiserHost, dnssd.WithLocalAddresses(advertiserHost.Addresses()))
+	assert.NoError(t, err)
+	defer advertiser.Close()
+
+	_, err = advertiser.RegisterService(dnssd.ServiceRegistration{
+		HostName:    "advertiser.local.",
+		Name:        "Living Room",
+		Port:        8080,
+		ServiceName: "_http._tcp.local.",
+	})
+	assert.NoError(t, err)
+
+	observer := network.NewHost(net.ParseIP("10.0.0.3"))
+	defer observer.Close()
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	browser.BrowseService("_http._tcp.local.")
+
+	// The browser's query is sent from the mDNS port, so it is answered with a multicast response carrying
+	// the records' full time-to-live rather than a legacy unicast response (RFC 6762 Section 6.7)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case received := <-observer.Receive():
+			assert.Equal(t, mdnsPort, received.Source.Port)
+
+			if !received.Msg.Response || len(received.Msg.Answer) == 0 {
+				continue
+			}
+
+			ptr, ok := received.Msg.Answer[0].(*dns.PTR)
+			if !ok || ptr.Hdr.Name != "_http._tcp.local." {
+				continue
+			}
+
+			assert.Equal(t, uint32(75*60), ptr.Hdr.Ttl)
+			return
+
+		case <-deadline:
+			t.Fatal("no multicast response to the browser's query")
+		}
+	}
+}
+
+func (tc *networkTestCase) run(t *testing.T) {
+	network := NewNetwork(tc.config)
+	sender := network.NewHost(net.ParseIP("10.0.0.1"))
+	receiver := network.NewHost(net.ParseIP("10.0.0.2"))
+	defer sender.Close()
+	defer receiver.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	assert.NoError(t, sender.Send(msg, tc.dst))
+
+	received := 0
+	for {
+		select {
+		case m := <-receiver.Receive():
+			assert.Equal(t, msg.Question, m.Msg.Question)
+			assert.Equal(t, net.ParseIP("10.0.0.1"), m.Source.IP)
+			assert.Equal(t, 1, m.InterfaceIndex)
+			received++
+
+		case <-time.After(receiveTimeout):
+			assert.Equal(t, tc.expectedReceived, received)
+			return
+		}
+	}
+}
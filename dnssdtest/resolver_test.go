@@ -0,0 +1,456 @@
+package dnssdtest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gatkin/dnssd"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverExpiresRecords(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	network := NewNetwork(Config{
+		Clock:      clock,
+		NoLoopback: true,
+	})
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")), dnssd.WithClock(clock))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	advertiser := network.NewHost(net.ParseIP("10.0.0.1"))
+	defer advertiser.Close()
+
+	events := browser.Subscribe("_http._tcp.local.")
+
+	// The browser's first query is sent after a short random delay. Answer it with the instance's records.
+	query := receiveAdvancing(t, clock, advertiser, 10*time.Millisecond)
+	assert.Equal(t, "_http._tcp.local.", query.Msg.Question[0].Name)
+	assert.NoError(t, advertiser.Send(newTestResponse(10), nil))
+
+	event := <-events
+	assert.Equal(t, dnssd.ServiceEventAdded, event.Type)
+
+	// Advance the clock until the records expire. The resolver processes each periodic update
+	// asynchronously, so the clock is advanced in small steps.
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			assert.Equal(t, dnssd.ServiceEventRemoved, event.Type)
+			assert.Equal(t, dnssd.RemovalReasonExpired, event.Reason)
+			assert.True(t, clock.Now().Sub(testStartTime) >= 10*time.Second)
+			return
+
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Second)
+
+		case <-deadline:
+			t.Fatal("records did not expire")
+		}
+	}
+}
+
+func TestResolverUnregisterKeepsSharedHost(t *testing.T) {
+	network := NewNetwork(Config{Delay: time.Millisecond})
+
+	advertiserHost := network.NewHost(net.ParseIP("10.0.0.1"))
+	advertiser, err := dnssd.NewResolverWithTransport(advertiserHost, dnssd.WithLocalAddresses(advertiserHost.Addresses()))
+	assert.NoError(t, err)
+	defer advertiser.Close()
+
+	instanceNames := make([]string, 0, 2)
+	for _, name := range []string{"Kitchen", "Living Room"} {
+		instanceName, err := advertiser.RegisterService(dnssd.ServiceRegistration{
+			HostName:    "advertiser.local.",
+			Name:        name,
+			Port:        8080,
+			ServiceName: "_http._tcp.local.",
+		})
+		assert.NoError(t, err)
+		instanceNames = append(instanceNames, instanceName)
+	}
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	events := browser.Subscribe("_http._tcp.local.")
+	for range instanceNames {
+		select {
+		case event := <-events:
+			assert.Equal(t, dnssd.ServiceEventAdded, event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatal("service instances were not discovered")
+		}
+	}
+
+	// The goodbye for the kitchen must not include the host's addresses, which the living room still uses
+	advertiser.UnregisterService(instanceNames[0])
+
+	select {
+	case event := <-events:
+		assert.Equal(t, dnssd.ServiceEventRemoved, event.Type)
+		assert.Equal(t, instanceNames[0], event.InstanceName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("service instance was not removed")
+	}
+
+	instances := browser.GetResolvedInstances("_http._tcp.local.")
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, instanceNames[1], instances[0].InstanceName)
+		assert.Equal(t, net.ParseIP("10.0.0.1").To4(), instances[0].Address)
+	}
+}
+
+func TestResolverProbesAgainAfterConflict(t *testing.T) {
+	network := NewNetwork(Config{Delay: time.Millisecond})
+
+	advertiserHost := network.NewHost(net.ParseIP("10.0.0.1"))
+	advertiser, err := dnssd.NewResolverWithTransport(advertiserHost, dnssd.WithLocalAddresses(advertiserHost.Addresses()))
+	assert.NoError(t, err)
+	defer advertiser.Close()
+
+	conflictCh := make(chan string, 1)
+	instanceName, err := advertiser.RegisterService(dnssd.ServiceRegistration{
+		HostName: "advertiser.local.",
+		Name:     "Printer",
+		OnNameConflict: func(oldName, newName string) {
+			conflictCh <- newName
+		},
+		Port:        8080,
+		ServiceName: "_http._tcp.local.",
+	})
+	assert.NoError(t, err)
+
+	// The other host joins once the name has been claimed, so it only sees what follows
+	other := network.NewHost(net.ParseIP("10.0.0.2"))
+	defer other.Close()
+
+	conflict := new(dns.Msg)
+	conflict.Response = true
+	conflict.Answer = []dns.RR{
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: instanceName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120},
+			Port:   9090,
+			Target: "other.local.",
+		},
+	}
+
+	// A single conflicting response may be stale, so the advertiser probes for its name again and keeps it
+	// if nobody defends it
+	assert.NoError(t, other.Send(conflict, nil))
+	receiveProbe(t, other, instanceName)
+	receiveAnnouncement(t, other, instanceName)
+
+	select {
+	case newName := <-conflictCh:
+		t.Fatalf("renamed to %v after a transient conflict", newName)
+	default:
+	}
+
+	// If the other host defends the name against the probe, the advertiser chooses a new one
+	assert.NoError(t, other.Send(conflict, nil))
+	receiveProbe(t, other, instanceName)
+	assert.NoError(t, other.Send(conflict, nil))
+
+	select {
+	case newName := <-conflictCh:
+		assert.Equal(t, "Printer (2)", newName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("service instance was not renamed")
+	}
+
+	receiveAnnouncement(t, other, `Printer\ \(2\)._http._tcp.local.`)
+}
+
+func TestResolverQueryBackoff(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	network := NewNetwork(Config{
+		Clock:      clock,
+		NoLoopback: true,
+	})
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")), dnssd.WithClock(clock))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	listener := network.NewHost(net.ParseIP("10.0.0.1"))
+	defer listener.Close()
+
+	browser.BrowseService("_http._tcp.local.")
+
+	// The first query is sent within 120 milliseconds, after which the interval between queries doubles
+	query := receiveAdvancing(t, clock, listener, 10*time.Millisecond)
+	assert.Equal(t, "_http._tcp.local.", query.Msg.Question[0].Name)
+
+	firstQueryTime := clock.Now()
+	assert.True(t, firstQueryTime.Sub(testStartTime) <= 120*time.Millisecond)
+
+	lastQueryTime := firstQueryTime
+	for _, expectedInterval := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		receiveAdvancing(t, clock, listener, 100*time.Millisecond)
+		interval := clock.Now().Sub(lastQueryTime)
+		assert.InDelta(t, expectedInterval.Seconds(), interval.Seconds(), 0.1)
+		lastQueryTime = clock.Now()
+	}
+}
+
+func TestResolverQueryRateWithAdvertiser(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	network := NewNetwork(Config{Clock: clock})
+
+	advertiserHost := network.NewHost(net.ParseIP("10.0.0.1"))
+	advertiser, err := dnssd.NewResolverWithTransport(advertiserHost, dnssd.WithClock(clock),
+		dnssd.WithLocalAddresses(advertiserHost.Addresses()))
+	assert.NoError(t, err)
+	defer advertiser.Close()
+
+	browserIP := net.ParseIP("10.0.0.2")
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(browserIP), dnssd.WithClock(clock))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	observer := network.NewHost(net.ParseIP("10.0.0.3"))
+	defer observer.Close()
+
+	// Registration only completes once the advertiser has probed for its name, which requires the clock
+	// to be advanced
+	registeredCh := make(chan error, 1)
+	go func() {
+		_, err := advertiser.RegisterService(dnssd.ServiceRegistration{
+			HostName:    "advertiser.local.",
+			Name:        "Living Room",
+			Port:        8080,
+			ServiceName: "_http._tcp.local.",
+		})
+		registeredCh <- err
+	}()
+
+	eventCh := browser.Subscribe("_http._tcp.local.")
+
+	// Browse for two simulated hours. Once the instance is discovered, the browser only needs to ask again
+	// as the continuous query backs off and as the records' time-to-live runs out, which for the host
+	// records is every two minutes.
+	end := testStartTime.Add(2 * time.Hour)
+	events := 0
+	queries := 0
+	for clock.Now().Before(end) {
+		select {
+		case err := <-registeredCh:
+			assert.NoError(t, err)
+
+		case event := <-eventCh:
+			assert.Equal(t, dnssd.ServiceEventAdded, event.Type)
+			events++
+
+		case received := <-observer.Receive():
+			if received.Source.IP.Equal(browserIP) && !received.Msg.Response {
+				queries++
+			}
+
+		case <-time.After(time.Millisecond):
+			clock.Advance(2 * time.Second)
+		}
+	}
+
+	// The instance is discovered once and never expires in between
+	assert.Equal(t, 1, events)
+	assert.True(t, queries < 150, "browser sent %d queries", queries)
+}
+
+func TestResolverFlushesUnansweredRecords(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	network := NewNetwork(Config{
+		Clock:      clock,
+		NoLoopback: true,
+	})
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")), dnssd.WithClock(clock))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	advertiser := network.NewHost(net.ParseIP("10.0.0.1"))
+	defer advertiser.Close()
+
+	peer := network.NewHost(net.ParseIP("10.0.0.3"))
+	defer peer.Close()
+
+	events := browser.Subscribe("_http._tcp.local.")
+
+	receiveAdvancing(t, clock, advertiser, 10*time.Millisecond)
+	assert.NoError(t, advertiser.Send(newTestResponse(4500), nil))
+	assert.Equal(t, dnssd.ServiceEventAdded, (<-events).Type)
+
+	// Another host asks for the instance twice, but the advertiser has left and does not answer
+	for i := 0; i < 2; i++ {
+		query := new(dns.Msg)
+		query.SetQuestion("test._http._tcp.local.", dns.TypeSRV)
+		assert.NoError(t, peer.Send(query, nil))
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			assert.Equal(t, dnssd.ServiceEventRemoved, event.Type)
+			assert.Equal(t, dnssd.RemovalReasonFlushed, event.Reason)
+			assert.True(t, clock.Now().Sub(testStartTime) < time.Minute)
+			return
+
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Second)
+
+		case <-deadline:
+			t.Fatal("records were not flushed")
+		}
+	}
+}
+
+func TestResolverReconfirmInstance(t *testing.T) {
+	clock := NewFakeClock(testStartTime)
+	network := NewNetwork(Config{
+		Clock:      clock,
+		NoLoopback: true,
+	})
+
+	browser, err := dnssd.NewResolverWithTransport(network.NewHost(net.ParseIP("10.0.0.2")), dnssd.WithClock(clock))
+	assert.NoError(t, err)
+	defer browser.Close()
+
+	advertiser := network.NewHost(net.ParseIP("10.0.0.1"))
+	defer advertiser.Close()
+
+	events := browser.Subscribe("_http._tcp.local.")
+
+	receiveAdvancing(t, clock, advertiser, 10*time.Millisecond)
+	assert.NoError(t, advertiser.Send(newTestResponse(4500), nil))
+	assert.Equal(t, dnssd.ServiceEventAdded, (<-events).Type)
+
+	browser.ReconfirmInstance("test._http._tcp.local.")
+
+	// The advertiser has left, so the reconfirmation queries go unanswered
+	query := <-advertiser.Receive()
+	assert.Contains(t, query.Msg.Question, dns.Question{
+		Name:   "test._http._tcp.local.",
+		Qtype:  dns.TypeSRV,
+		Qclass: dns.ClassINET,
+	})
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			assert.Equal(t, dnssd.ServiceEventRemoved, event.Type)
+			assert.Equal(t, dnssd.RemovalReasonFlushed, event.Reason)
+			assert.True(t, clock.Now().Sub(testStartTime) < time.Minute)
+			return
+
+		case <-advertiser.Receive():
+
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Second)
+
+		case <-deadline:
+			t.Fatal("records were not flushed")
+		}
+	}
+}
+
+// newTestResponse creates a response containing all records of a single service instance with the given
+// time-to-live in seconds.
+func newTestResponse(ttl uint32) *dns.Msg {
+	header := func(name string, rrType uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Name:   name,
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{
+			Hdr: header("_http._tcp.local.", dns.TypePTR),
+			Ptr: "test._http._tcp.local.",
+		},
+	}
+	msg.Extra = []dns.RR{
+		&dns.SRV{
+			Hdr:    header("test._http._tcp.local.", dns.TypeSRV),
+			Port:   8080,
+			Target: "test-host.local.",
+		},
+		&dns.TXT{
+			Hdr: header("test._http._tcp.local.", dns.TypeTXT),
+			Txt: []string{"path=/"},
+		},
+		&dns.A{
+			Hdr: header("test-host.local.", dns.TypeA),
+			A:   net.ParseIP("10.0.0.1"),
+		},
+	}
+
+	return msg
+}
+
+// receiveAdvancing advances the clock in steps of the given duration until the host receives a message.
+// The resolver handles its timers asynchronously, so each step waits briefly for a message first.
+func receiveAdvancing(t *testing.T, clock *FakeClock, host *Host, step time.Duration) dnssd.ReceivedMessage {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-host.Receive():
+			return msg
+
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(step)
+
+		case <-deadline:
+			t.Fatal("no message received")
+		}
+	}
+}
+
+// receiveAnnouncement waits until the host receives an announcement of the service instance with the
+// given name.
+func receiveAnnouncement(t *testing.T, host *Host, instanceName string) {
+	receiveMatching(t, host, func(msg *dns.Msg) bool {
+		for _, rr := range msg.Answer {
+			if _, ok := rr.(*dns.SRV); ok && msg.Response && rr.Header().Name == instanceName {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// receiveMatching waits until the host receives a message for which match returns true, skipping all
+// other messages.
+func receiveMatching(t *testing.T, host *Host, match func(msg *dns.Msg) bool) {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case received := <-host.Receive():
+			if match(received.Msg) {
+				return
+			}
+
+		case <-deadline:
+			t.Fatal("no matching message received")
+		}
+	}
+}
+
+// receiveProbe waits until the host receives a probe for the service instance with the given name.
+func receiveProbe(t *testing.T, host *Host, instanceName string) {
+	receiveMatching(t, host, func(msg *dns.Msg) bool {
+		return !msg.Response && len(msg.Ns) > 0 && msg.Question[0].Name == instanceName
+	})
+}
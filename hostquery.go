@@ -0,0 +1,68 @@
+package dnssd
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+// hostQueryRequest contains all data to request querying a single host directly.
+type hostQueryRequest struct {
+	address    net.IP
+	ctx        context.Context
+	question   question
+	responseCh chan error
+}
+
+// checkPendingHostQueries completes all pending requests to query a host that are answered by the given
+// answers. Requests whose context is done are discarded.
+func (r *Resolver) checkPendingHostQueries(answers answerSet) {
+	pending := r.pendingHostQueries[:0]
+
+	for _, request := range r.pendingHostQueries {
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		if answers.source != nil && answers.source.IP.Equal(request.address) && answers.answersQuestion(request.question) {
+			request.responseCh <- nil
+			continue
+		}
+
+		pending = append(pending, request)
+	}
+
+	r.pendingHostQueries = pending
+}
+
+// prunePendingHostQueries discards all pending requests to query a host whose context is done.
+func (r *Resolver) prunePendingHostQueries() {
+	pending := r.pendingHostQueries[:0]
+
+	for _, request := range r.pendingHostQueries {
+		if request.ctx.Err() == nil {
+			pending = append(pending, request)
+		}
+	}
+
+	r.pendingHostQueries = pending
+}
+
+// onHostQueryRequested handles a request to query a single host directly. Known answers are not included
+// so that the host answers even if the records are already cached.
+func (r *Resolver) onHostQueryRequested(request hostQueryRequest) {
+	log.Printf("Sending question %v to %v\n", request.question, request.address)
+
+	addr := &net.UDPAddr{
+		IP:   request.address,
+		Port: mdnsPort,
+	}
+
+	err := r.netClient.sendQueryTo(questionsToMessage([]question{request.question}), addr)
+	if err != nil {
+		request.responseCh <- err
+		return
+	}
+
+	r.pendingHostQueries = append(r.pendingHostQueries, request)
+}
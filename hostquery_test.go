@@ -0,0 +1,85 @@
+package dnssd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryHost(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	address := net.ParseIP("192.168.2.10").To4()
+	q := dns.Question{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	go func() {
+		sent := <-transport.sentCh
+		assert.Equal(t, &net.UDPAddr{IP: address, Port: mdnsPort}, sent.dst)
+		assert.Equal(t, []dns.Question{q}, sent.msg.Question)
+		assert.Empty(t, sent.msg.Answer)
+
+		response := new(dns.Msg)
+		response.Response = true
+		response.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   address,
+			},
+		}
+
+		// A response from another host must not complete the query
+		other := &net.UDPAddr{IP: net.ParseIP("192.168.2.11"), Port: mdnsPort}
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response, Source: other}
+
+		source := &net.UDPAddr{IP: address, Port: mdnsPort}
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response, Source: source}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, resolver.QueryHost(ctx, address, q))
+}
+
+func TestQueryHostNoResponse(t *testing.T) {
+	resolver, _ := newTestResolver(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	q := dns.Question{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	assert.Equal(t, context.DeadlineExceeded, resolver.QueryHost(ctx, net.ParseIP("192.168.2.10"), q))
+}
+
+func TestQueryHostUnsupportedClass(t *testing.T) {
+	resolver, _ := newTestResolver(t)
+
+	q := dns.Question{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}
+	assert.Error(t, resolver.QueryHost(context.Background(), net.ParseIP("192.168.2.10"), q))
+}
+
+func TestUpdateTimerPrunesHostQueries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resolver := Resolver{
+		cache:           newCache(),
+		clock:           SystemClock(),
+		lastCacheUpdate: time.Now(),
+		pendingHostQueries: []hostQueryRequest{
+			{ctx: ctx, address: net.ParseIP("10.0.0.1"), responseCh: make(chan error, 1)},
+			{ctx: context.Background(), address: net.ParseIP("10.0.0.2"), responseCh: make(chan error, 1)},
+		},
+		updateTimer: timerCreate(SystemClock()),
+	}
+
+	// Requests whose context is done are discarded even if no answers are received
+	resolver.onUpdateTimer()
+
+	assert.Len(t, resolver.pendingHostQueries, 1)
+	assert.Equal(t, net.ParseIP("10.0.0.2"), resolver.pendingHostQueries[0].address)
+}
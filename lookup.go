@@ -0,0 +1,184 @@
+package dnssd
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// lookupAddrRequest contains all data to request the host names of an address.
+type lookupAddrRequest struct {
+	ctx         context.Context
+	query       *continuousQuery // Schedules asking again while no host name is known
+	responseCh  chan []string
+	reverseName string // The address's name in the reverse mapping domain, e.g. "10.1.168.192.in-addr.arpa."
+}
+
+// lookupHostRequest contains all data to request the addresses of a host.
+type lookupHostRequest struct {
+	ctx        context.Context
+	hostName   hostName
+	query      *continuousQuery // Schedules asking again while no address is known
+	responseCh chan []HostAddress
+}
+
+// getHostAddressQuestions returns the questions for the IPv4 and IPv6 addresses of the given host.
+func getHostAddressQuestions(name hostName) map[question]bool {
+	ipV4Question := question{
+		name:         name.String(),
+		questionType: questionTypeIPv4Address,
+	}
+
+	ipV6Question := question{
+		name:         name.String(),
+		questionType: questionTypeIPv6Address,
+	}
+
+	return map[question]bool{ipV4Question: true, ipV6Question: true}
+}
+
+// getReverseQuestion returns the question for the reverse mapping pointer records of the address with the
+// given reverse mapping name.
+func getReverseQuestion(reverseName string) question {
+	return question{
+		name:         reverseName,
+		questionType: questionTypePointer,
+	}
+}
+
+// getHostNames returns the sorted host names pointed to by the reverse mapping pointer records with the
+// given name in the cache. Names for which a goodbye has been received are left out.
+func (c *cache) getHostNames(reverseName string) []string {
+	names := make([]string, 0)
+	for _, generic := range c.genericRecords {
+		ptr, ok := generic.rr.(*dns.PTR)
+		if !ok || generic.goodbye || !strings.EqualFold(generic.getName(), reverseName) {
+			continue
+		}
+
+		names = append(names, ptr.Ptr)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// getHostAddresses returns the addresses of the host with the given name in the cache, ordered by address.
+// Addresses for which a goodbye has been received are left out.
+func (c *cache) getHostAddresses(name hostName) []HostAddress {
+	addresses := make([]HostAddress, 0)
+	for _, address := range c.addressRecords {
+		if address.goodbye || !strings.EqualFold(address.name.String(), name.String()) {
+			continue
+		}
+
+		addresses = append(addresses, HostAddress{
+			Address:    address.address,
+			TimeToLive: address.remainingTimeToLive,
+		})
+	}
+
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i].Address, addresses[j].Address) < 0
+	})
+
+	return addresses
+}
+
+// checkPendingAddrLookups completes all pending requests to look up the host names of addresses that are
+// now in the cache. Requests whose context is done are discarded.
+func (r *Resolver) checkPendingAddrLookups() {
+	pending := r.pendingAddrLookups[:0]
+
+	for _, request := range r.pendingAddrLookups {
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		if r.tryLookupAddr(request) {
+			continue
+		}
+
+		pending = append(pending, request)
+	}
+
+	r.pendingAddrLookups = pending
+}
+
+// checkPendingHostLookups completes all pending requests to look up hosts whose addresses are now in the
+// cache. Requests whose context is done are discarded.
+func (r *Resolver) checkPendingHostLookups() {
+	pending := r.pendingHostLookups[:0]
+
+	for _, request := range r.pendingHostLookups {
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		if r.tryLookupHost(request) {
+			continue
+		}
+
+		pending = append(pending, request)
+	}
+
+	r.pendingHostLookups = pending
+}
+
+// onLookupAddrRequested handles a request to look up the host names of an address.
+func (r *Resolver) onLookupAddrRequested(request lookupAddrRequest) {
+	r.onTimeElapsed()
+	if r.tryLookupAddr(request) {
+		return
+	}
+
+	log.Printf("Looking up address %v\n", request.reverseName)
+	r.sendQuestionSet(map[question]bool{getReverseQuestion(request.reverseName): true})
+
+	request.query.onQuerySent(r.clock.Now())
+	r.pendingAddrLookups = append(r.pendingAddrLookups, request)
+	r.scheduleUpdateTimer()
+}
+
+// onLookupHostRequested handles a request to look up the addresses of a host.
+func (r *Resolver) onLookupHostRequested(request lookupHostRequest) {
+	r.onTimeElapsed()
+	if r.tryLookupHost(request) {
+		return
+	}
+
+	log.Printf("Looking up host %v\n", request.hostName)
+	r.sendQuestionSet(getHostAddressQuestions(request.hostName))
+
+	request.query.onQuerySent(r.clock.Now())
+	r.pendingHostLookups = append(r.pendingHostLookups, request)
+	r.scheduleUpdateTimer()
+}
+
+// tryLookupAddr completes the given request if any host names of the requested address are in the cache.
+// Returns true if the request was completed.
+func (r *Resolver) tryLookupAddr(request lookupAddrRequest) bool {
+	names := r.cache.getHostNames(request.reverseName)
+	if len(names) == 0 {
+		return false
+	}
+
+	request.responseCh <- names
+	return true
+}
+
+// tryLookupHost completes the given request if any addresses of the requested host are in the cache.
+// Returns true if the request was completed.
+func (r *Resolver) tryLookupHost(request lookupHostRequest) bool {
+	addresses := r.cache.getHostAddresses(request.hostName)
+	if len(addresses) == 0 {
+		return false
+	}
+
+	request.responseCh <- addresses
+	return true
+}
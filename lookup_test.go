@@ -0,0 +1,99 @@
+package dnssd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupHost(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	go func() {
+		sent := <-transport.sentCh
+		assert.ElementsMatch(t, []dns.Question{
+			{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "printer.local.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		}, sent.msg.Question)
+
+		response := new(dns.Msg)
+		response.Response = true
+		response.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   net.ParseIP("192.168.1.10").To4(),
+			},
+			&dns.AAAA{
+				Hdr:  dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 120},
+				AAAA: net.ParseIP("fe80::10"),
+			},
+		}
+
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	addresses, err := resolver.LookupHost(ctx, "printer.local.")
+	assert.NoError(t, err)
+	assert.Len(t, addresses, 2)
+	assert.True(t, addresses[0].Address.Equal(net.ParseIP("192.168.1.10")))
+	assert.True(t, addresses[1].Address.Equal(net.ParseIP("fe80::10")))
+	assert.True(t, addresses[0].TimeToLive > 119*time.Second && addresses[0].TimeToLive <= 120*time.Second)
+
+	// Cached addresses are returned without asking again, regardless of case
+	addresses, err = resolver.LookupHost(ctx, "PRINTER.local.")
+	assert.NoError(t, err)
+	assert.Len(t, addresses, 2)
+	assert.Empty(t, transport.sentCh)
+
+	// The trailing dot may be omitted
+	addresses, err = resolver.LookupHost(ctx, "printer.local")
+	assert.NoError(t, err)
+	assert.Len(t, addresses, 2)
+	assert.Empty(t, transport.sentCh)
+}
+
+func TestLookupAddr(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	go func() {
+		sent := <-transport.sentCh
+		assert.Equal(t, []dns.Question{
+			{Name: "10.1.168.192.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		}, sent.msg.Question)
+
+		response := new(dns.Msg)
+		response.Response = true
+		response.Answer = []dns.RR{
+			&dns.PTR{
+				Hdr: dns.RR_Header{Name: "10.1.168.192.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+				Ptr: "printer.local.",
+			},
+		}
+
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, net.ParseIP("192.168.1.10"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"printer.local."}, names)
+
+	// The reverse mapping pointer does not show up as a service instance
+	assert.Empty(t, resolver.GetAllResolvedInstances())
+}
+
+func TestLookupAddrInvalidAddress(t *testing.T) {
+	resolver, _ := newTestResolver(t)
+
+	_, err := resolver.LookupAddr(context.Background(), nil)
+	assert.Error(t, err)
+}
@@ -1,7 +1,11 @@
 package dnssd
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,6 +18,14 @@ type serviceInstanceName string
 
 type serviceName string
 
+// serviceTypeEnumerationName is the name queried to discover all service types advertised on the network
+// (RFC 6763 Section 9).
+const serviceTypeEnumerationName = serviceName("_services._dns-sd._udp.local.")
+
+// subtypeSeparator separates the subtype label from the service name in the name of a subtype PTR record,
+// e.g. "_printer._sub._http._tcp.local." (RFC 6763 Section 7.1).
+const subtypeSeparator = "._sub."
+
 // addressRecord contains received address information.
 type addressRecord struct {
 	address net.IP
@@ -24,14 +36,24 @@ type addressRecord struct {
 // answerSet represents a set of answers received in a single DNS answer message.
 type answerSet struct {
 	addressRecords []addressRecord
+	genericRecords []genericRecord
 	pointerRecords []pointerRecord
 	serviceRecords []serviceRecord
+	source         *net.UDPAddr // Address of the responder that sent the answers
 	textRecords    []textRecord
 }
 
+// genericRecord contains a received record without dedicated handling, such as an HINFO, NSEC, or CNAME
+// record, a TXT record of a name that is not a service instance, or a reverse mapping PTR record.
+type genericRecord struct {
+	rr dns.RR // The record as received
+	resourceRecord
+}
+
 // messagePipeline filters, transforms, and pipes raw DNS messages
 type messagePipeline struct {
 	answerCh   chan answerSet
+	queryCh    chan query
 	shutdownCh chan struct{}
 }
 
@@ -39,14 +61,32 @@ type messagePipeline struct {
 type pointerRecord struct {
 	instanceName serviceInstanceName
 	serviceName  serviceName
+	subtype      string // Subtype label for selective instance enumeration, empty for the base service
 	resourceRecord
 }
 
+// query represents the set of questions received in a single DNS query message.
+type query struct {
+	authorities  []dns.RR
+	id           uint16
+	knownAnswers []dns.RR
+	questions    []question
+	source       *net.UDPAddr
+	truncated    bool // Whether more known answers follow in subsequent packets
+}
+
 // resourceRecord contains fields common to all resource records.
 type resourceRecord struct {
 	cacheFlush          bool
+	flushed             bool // Whether the record is expiring because queries for it went unanswered
+	goodbye             bool // Whether a goodbye has been received for the record, or it has been flushed
 	initialTimeToLive   time.Duration
+	poofTimeToLive      time.Duration // Remaining TTL at which to flush the record if queries stay unanswered
+	refreshAttempts     int           // Number of refresh queries sent for the record
+	refreshJitter       float64       // Random variation added to the fractions of the TTL at which to refresh
 	remainingTimeToLive time.Duration
+	renewals            int // Number of times the cached record was received again with a renewed time-to-live
+	unansweredQueries   int // Number of queries for the record seen or sent without an answer
 }
 
 // serviceRecord contains information received for an instance's SRV record.
@@ -61,6 +101,7 @@ type serviceRecord struct {
 // textRecord contains information received for an instances TXT record.
 type textRecord struct {
 	instanceName serviceInstanceName
+	raw          [][]byte // The record's strings as received or registered, without presentation format escapes
 	serviceName  serviceName
 	values       map[string]string
 	resourceRecord
@@ -84,15 +125,42 @@ func aToAddressRecord(a *dns.A) addressRecord {
 	}
 }
 
+// cacheFlushBit is the highest order bit of a resource record's class and indicates cache flush
+// (RFC 6762 Section 10.2).
+const cacheFlushBit = 15
+
+// unicastResponseBit is the highest order bit of a question's class and indicates that a unicast response
+// is preferred (RFC 6762 Section 5.4).
+const unicastResponseBit = 15
+
 // cacheFlushIsSet returns true if the RR's cache flush bit is set.
 func cacheFlushIsSet(header *dns.RR_Header) bool {
-	const (
-		cacheFlushBit = 15 // Highest order bit indicates cache flush (RFC 6762 Section 10.2)
-	)
-
 	return (header.Class & (1 << cacheFlushBit)) != 0
 }
 
+// dnsQuestionToQuestion converts a DNS question into the corresponding question. Returns false if the
+// question is not for the Internet class.
+func dnsQuestionToQuestion(q *dns.Question) (question, bool) {
+	class := q.Qclass &^ (1 << unicastResponseBit)
+	if class != dns.ClassINET && class != dns.ClassANY {
+		return question{}, false
+	}
+
+	return question{
+		name:            q.Name,
+		questionType:    questionType(q.Qtype),
+		unicastResponse: (q.Qclass & (1 << unicastResponseBit)) != 0,
+	}, true
+}
+
+// rrToGenericRecord converts any DNS record into a generic record.
+func rrToGenericRecord(rr dns.RR) genericRecord {
+	return genericRecord{
+		rr:             rr,
+		resourceRecord: headerToResourceRecord(rr.Header()),
+	}
+}
+
 // headerToResourceRecord converts an RR header into a resource record.
 func headerToResourceRecord(header *dns.RR_Header) resourceRecord {
 	timeToLive := time.Duration(header.Ttl) * time.Second
@@ -100,6 +168,7 @@ func headerToResourceRecord(header *dns.RR_Header) resourceRecord {
 	return resourceRecord{
 		cacheFlush:          cacheFlushIsSet(header),
 		initialTimeToLive:   timeToLive,
+		refreshJitter:       rand.Float64() * maxRefreshJitter,
 		remainingTimeToLive: timeToLive,
 	}
 }
@@ -108,66 +177,233 @@ func headerToResourceRecord(header *dns.RR_Header) resourceRecord {
 func newMessagePipeline() messagePipeline {
 	return messagePipeline{
 		answerCh:   make(chan answerSet),
+		queryCh:    make(chan query),
 		shutdownCh: make(chan struct{}),
 	}
 }
 
-// ptrToPointerRecord converts a PTR record into a pointer record.
+// labelEscape escapes the given string so that it may be used as a single label of a domain name. Escapes
+// match the presentation format of names unpacked from received messages so that both compare equal.
+func labelEscape(label string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+
+		switch {
+		case strings.IndexByte(`.'@;()"\ `, c) >= 0:
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&escaped, "\\%03d", c)
+
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// ptrToPointerRecord converts a PTR record into a pointer record. Subtype PTR records are filed under
+// their base service.
 func ptrToPointerRecord(ptr *dns.PTR) pointerRecord {
+	name, subtype := splitSubtype(serviceName(ptr.Hdr.Name))
+
 	return pointerRecord{
 		instanceName:   serviceInstanceName(ptr.Ptr),
-		serviceName:    serviceName(ptr.Hdr.Name),
+		serviceName:    name,
+		subtype:        subtype,
 		resourceRecord: headerToResourceRecord(&ptr.Hdr),
 	}
 }
 
-// serviceNameFromInstanceName extracts the service name from the given instance name.
-func serviceNameFromInstanceName(instanceName serviceInstanceName) serviceName {
-	return serviceName(strings.SplitN(instanceName.String(), ".", 2)[1])
+// splitSubtype splits a subtype service name such as "_printer._sub._http._tcp.local." into its base
+// service name and subtype label. Returns the name unchanged and an empty subtype for names that do not
+// refer to a subtype.
+func splitSubtype(name serviceName) (serviceName, string) {
+	i := strings.LastIndex(strings.ToLower(name.String()), subtypeSeparator)
+	if i < 0 {
+		return name, ""
+	}
+
+	return name[i+len(subtypeSeparator):], name.String()[:i]
 }
 
-// srvToServiceRecord converts an SRV record into a service record.
-func srvToServiceRecord(srv *dns.SRV) serviceRecord {
-	instanceName := serviceInstanceName(srv.Hdr.Name)
-	serviceName := serviceNameFromInstanceName(instanceName)
+// srvToServiceRecord converts an SRV record into a service record. Returns false if the record's name is
+// not a service instance name.
+func srvToServiceRecord(srv *dns.SRV) (serviceRecord, bool) {
+	name, err := ParseInstanceName(srv.Hdr.Name)
+	if err != nil {
+		return serviceRecord{}, false
+	}
 
 	return serviceRecord{
-		instanceName:   instanceName,
+		instanceName:   serviceInstanceName(srv.Hdr.Name),
 		port:           srv.Port,
-		serviceName:    serviceName,
+		serviceName:    name.getServiceName(),
 		target:         hostName(srv.Target),
 		resourceRecord: headerToResourceRecord(&srv.Hdr),
-	}
+	}, true
 }
 
-// txtToMap converts a TXT record to a key-value map.
-func txtToMap(txt *dns.TXT) map[string]string {
+// txtToMap converts the strings of a TXT record to a key-value map following RFC 6763 Section 6. Keys are
+// converted to lower case, since they are case insensitive, and only the first occurrence of a key is
+// used. Boolean attributes, which have no '=', are mapped to an empty value.
+func txtToMap(raw [][]byte) map[string]string {
 	values := make(map[string]string)
 
-	for _, value := range txt.Txt {
-		kvPair := strings.Split(value, "=")
-		if len(kvPair) != 2 {
-			// Malformed TXT record
+	for _, attribute := range raw {
+		key := attribute
+		value := []byte{}
+		if i := bytes.IndexByte(attribute, '='); i >= 0 {
+			key = attribute[:i]
+			value = attribute[i+1:]
+		}
+
+		if len(key) == 0 {
+			// Strings without a key, including empty strings, are silently ignored (RFC 6763 Section 6.4)
+			continue
+		}
+
+		lowerKey := strings.ToLower(string(key))
+		if _, ok := values[lowerKey]; ok {
 			continue
 		}
 
-		values[kvPair[0]] = kvPair[1]
+		values[lowerKey] = string(value)
 	}
 
 	return values
 }
 
-// txtToTextRecord converts a TXT record into a text record.
-func txtToTextRecord(txt *dns.TXT) textRecord {
-	instanceName := serviceInstanceName(txt.Hdr.Name)
-	serviceName := serviceNameFromInstanceName(instanceName)
+// mapToTXT converts the given attributes into "key=value" strings ordered by key.
+func mapToTXT(values map[string]string) [][]byte {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	raw := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		raw = append(raw, []byte(key+"="+values[key]))
+	}
+
+	return raw
+}
+
+// txtToTextRecord converts a TXT record into a text record. Returns false if the record's name is not a
+// service instance name.
+func txtToTextRecord(txt *dns.TXT) (textRecord, bool) {
+	name, err := ParseInstanceName(txt.Hdr.Name)
+	if err != nil {
+		return textRecord{}, false
+	}
+
+	raw := make([][]byte, 0, len(txt.Txt))
+	for _, value := range txt.Txt {
+		raw = append(raw, txtUnescape(value))
+	}
 
 	return textRecord{
-		instanceName:   instanceName,
-		serviceName:    serviceName,
-		values:         txtToMap(txt),
+		instanceName:   serviceInstanceName(txt.Hdr.Name),
+		raw:            raw,
+		serviceName:    name.getServiceName(),
+		values:         txtToMap(raw),
 		resourceRecord: headerToResourceRecord(&txt.Hdr),
+	}, true
+}
+
+// txtEscape escapes the given string so that it is packed verbatim into a TXT record.
+func txtEscape(value string) string {
+	return strings.Replace(value, `\`, `\\`, -1)
+}
+
+// txtUnescape removes the presentation format escapes from a string of a received TXT record, returning
+// the string's original bytes.
+func txtUnescape(value string) []byte {
+	unescaped := make([]byte, 0, len(value))
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] != '\\' || i+1 == len(value):
+			unescaped = append(unescaped, value[i])
+
+		case i+3 < len(value) && isDigits(value[i+1:i+4]):
+			b := int(value[i+1]-'0')*100 + int(value[i+2]-'0')*10 + int(value[i+3]-'0')
+			unescaped = append(unescaped, byte(b))
+			i += 3
+
+		default:
+			unescaped = append(unescaped, value[i+1])
+			i++
+		}
 	}
+
+	return unescaped
+}
+
+// answersQuestion returns true if any of the answers answers the given question.
+func (a *answerSet) answersQuestion(q question) bool {
+	for i := range a.addressRecords {
+		if q.isAnsweredBy(a.addressRecords[i].name.String(), a.addressRecords[i].getQuestion().questionType) {
+			return true
+		}
+	}
+
+	for i := range a.genericRecords {
+		if q.isAnsweredBy(a.genericRecords[i].getName(), a.genericRecords[i].getQuestionType()) {
+			return true
+		}
+	}
+
+	for i := range a.pointerRecords {
+		if q.isAnsweredBy(a.pointerRecords[i].getName().String(), questionTypePointer) {
+			return true
+		}
+	}
+
+	for i := range a.serviceRecords {
+		if q.isAnsweredBy(a.serviceRecords[i].instanceName.String(), questionTypeService) {
+			return true
+		}
+	}
+
+	for i := range a.textRecords {
+		if q.isAnsweredBy(a.textRecords[i].instanceName.String(), questionTypeText) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// toDNSRecords converts all records of the answer set into the corresponding DNS records.
+func (a *answerSet) toDNSRecords() []dns.RR {
+	records := make([]dns.RR, 0, len(a.addressRecords)+len(a.genericRecords)+len(a.pointerRecords)+len(a.serviceRecords)+len(a.textRecords))
+
+	for i := range a.addressRecords {
+		records = append(records, a.addressRecords[i].toDNSRecord())
+	}
+
+	for i := range a.genericRecords {
+		records = append(records, a.genericRecords[i].toDNSRecord())
+	}
+
+	for i := range a.pointerRecords {
+		records = append(records, a.pointerRecords[i].toDNSRecord())
+	}
+
+	for i := range a.serviceRecords {
+		records = append(records, a.serviceRecords[i].toDNSRecord())
+	}
+
+	for i := range a.textRecords {
+		records = append(records, a.textRecords[i].toDNSRecord())
+	}
+
+	return records
 }
 
 // isIPv4 returns true if the given address record is for an IPv4 address.
@@ -175,26 +411,128 @@ func (a *addressRecord) isIPv4() bool {
 	return a.address.To4() != nil
 }
 
+// toDNSRecord converts the address record into the corresponding A or AAAA record.
+func (a *addressRecord) toDNSRecord() dns.RR {
+	if a.isIPv4() {
+		return &dns.A{
+			Hdr: a.toDNSHeader(a.name.String(), dns.TypeA),
+			A:   a.address.To4(),
+		}
+	}
+
+	return &dns.AAAA{
+		Hdr:  a.toDNSHeader(a.name.String(), dns.TypeAAAA),
+		AAAA: a.address,
+	}
+}
+
+// getName returns the name of the generic record.
+func (g *genericRecord) getName() string {
+	return g.rr.Header().Name
+}
+
+// getQuestionType returns the type of question answered by the generic record.
+func (g *genericRecord) getQuestionType() questionType {
+	return questionType(g.rr.Header().Rrtype)
+}
+
+// toDNSRecord converts the generic record into a copy of the record it was received as, with its
+// remaining time-to-live.
+func (g *genericRecord) toDNSRecord() dns.RR {
+	rr := dns.Copy(g.rr)
+	*rr.Header() = g.toDNSHeader(g.getName(), g.rr.Header().Rrtype)
+
+	return rr
+}
+
 // String converts a host name to a string.
 func (h hostName) String() string {
 	return string(h)
 }
 
-// close closes the message pipeline.
+// getName returns the name of the pointer record, which is the subtype service name for subtype
+// pointer records.
+func (p *pointerRecord) getName() serviceName {
+	if p.subtype == "" {
+		return p.serviceName
+	}
+
+	return serviceName(p.subtype + subtypeSeparator + p.serviceName.String())
+}
+
+// toDNSRecord converts the pointer record into the corresponding PTR record.
+func (p *pointerRecord) toDNSRecord() dns.RR {
+	return &dns.PTR{
+		Hdr: p.toDNSHeader(p.getName().String(), dns.TypePTR),
+		Ptr: p.instanceName.String(),
+	}
+}
+
+// toDNSHeader creates the header for a record of the given name and type containing the resource
+// record's time-to-live and cache flush bit.
+func (r *resourceRecord) toDNSHeader(name string, rrType uint16) dns.RR_Header {
+	class := uint16(dns.ClassINET)
+	if r.cacheFlush {
+		class |= 1 << cacheFlushBit
+	}
+
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrType,
+		Class:  class,
+		Ttl:    uint32(r.remainingTimeToLive / time.Second),
+	}
+}
+
+// toDNSRecord converts the service record into the corresponding SRV record.
+func (s *serviceRecord) toDNSRecord() dns.RR {
+	return &dns.SRV{
+		Hdr:    s.toDNSHeader(s.instanceName.String(), dns.TypeSRV),
+		Port:   s.port,
+		Target: s.target.String(),
+	}
+}
+
+// toDNSRecord converts the text record into the corresponding TXT record. Records received or registered
+// with raw strings keep those strings.
+func (t *textRecord) toDNSRecord() dns.RR {
+	raw := t.raw
+	if raw == nil {
+		raw = mapToTXT(t.values)
+	}
+
+	txt := make([]string, 0, len(raw))
+	for _, value := range raw {
+		txt = append(txt, txtEscape(string(value)))
+	}
+
+	if len(txt) == 0 {
+		// A TXT record must contain at least one string, which may be empty (RFC 6763 Section 6.1)
+		txt = append(txt, "")
+	}
+
+	return &dns.TXT{
+		Hdr: t.toDNSHeader(t.instanceName.String(), dns.TypeTXT),
+		Txt: txt,
+	}
+}
+
+// close closes the message pipeline. Messages the pipeline is still trying to deliver are dropped.
 func (p *messagePipeline) close() {
-	go func() {
-		p.shutdownCh <- struct{}{}
-	}()
+	close(p.shutdownCh)
 }
 
 // onMessageReceived handles receiving the given message.
-func (p *messagePipeline) onMessageReceived(msg dns.Msg) {
+func (p *messagePipeline) onMessageReceived(received ReceivedMessage) {
+	msg := received.Msg
 	if !msg.Response {
-		// Don't care about messages that are not questions
+		p.onQueryReceived(received)
 		return
 	}
 
-	answerSet := answerSet{}
+	answerSet := answerSet{
+		source: received.Source,
+	}
 	resourceRecords := append(msg.Answer, msg.Extra...)
 
 	for _, rr := range resourceRecords {
@@ -203,21 +541,68 @@ func (p *messagePipeline) onMessageReceived(msg dns.Msg) {
 			answerSet.addressRecords = append(answerSet.addressRecords, aToAddressRecord(resourceRecord))
 		case *dns.AAAA:
 			answerSet.addressRecords = append(answerSet.addressRecords, aaaaToAddressRecord(resourceRecord))
+		case *dns.OPT:
+			// EDNS pseudo-records do not describe any name and are not cached
 		case *dns.PTR:
-			answerSet.pointerRecords = append(answerSet.pointerRecords, ptrToPointerRecord(resourceRecord))
+			if isReverseMappingName(resourceRecord.Hdr.Name) {
+				// Reverse mapping pointers point to host names rather than service instances
+				answerSet.genericRecords = append(answerSet.genericRecords, rrToGenericRecord(rr))
+			} else {
+				answerSet.pointerRecords = append(answerSet.pointerRecords, ptrToPointerRecord(resourceRecord))
+			}
 		case *dns.SRV:
-			answerSet.serviceRecords = append(answerSet.serviceRecords, srvToServiceRecord(resourceRecord))
+			if record, ok := srvToServiceRecord(resourceRecord); ok {
+				answerSet.serviceRecords = append(answerSet.serviceRecords, record)
+			} else {
+				answerSet.genericRecords = append(answerSet.genericRecords, rrToGenericRecord(rr))
+			}
 		case *dns.TXT:
-			answerSet.textRecords = append(answerSet.textRecords, txtToTextRecord(resourceRecord))
+			if record, ok := txtToTextRecord(resourceRecord); ok {
+				answerSet.textRecords = append(answerSet.textRecords, record)
+			} else {
+				answerSet.genericRecords = append(answerSet.genericRecords, rrToGenericRecord(rr))
+			}
+		default:
+			answerSet.genericRecords = append(answerSet.genericRecords, rrToGenericRecord(rr))
+		}
+	}
+
+	select {
+	case p.answerCh <- answerSet:
+	case <-p.shutdownCh:
+	}
+}
+
+// onQueryReceived handles receiving the given query message.
+func (p *messagePipeline) onQueryReceived(received ReceivedMessage) {
+	query := query{
+		authorities:  received.Msg.Ns,
+		id:           received.Msg.Id,
+		knownAnswers: received.Msg.Answer,
+		source:       received.Source,
+		truncated:    received.Msg.Truncated,
+	}
+
+	for i := range received.Msg.Question {
+		if question, ok := dnsQuestionToQuestion(&received.Msg.Question[i]); ok {
+			query.questions = append(query.questions, question)
 		}
 	}
 
-	p.answerCh <- answerSet
+	if len(query.questions) == 0 && len(query.knownAnswers) == 0 {
+		// Packets without questions only matter if they continue the known answers of a truncated query
+		return
+	}
+
+	select {
+	case p.queryCh <- query:
+	case <-p.shutdownCh:
+	}
 }
 
 // pipeMessages filters, transforms, and pipes the appropriate messages from the raw DNS message channel into the
 // correct output channels.
-func (p *messagePipeline) pipeMessages(msgCh <-chan dns.Msg) {
+func (p *messagePipeline) pipeMessages(msgCh <-chan ReceivedMessage) {
 	for {
 		select {
 		case <-p.shutdownCh:
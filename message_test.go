@@ -0,0 +1,267 @@
+package dnssd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type ptrToPointerRecordTestCase struct {
+	name            string
+	expectedService serviceName
+	expectedSubtype string
+}
+
+func TestPtrToPointerRecord(t *testing.T) {
+	testCase := ptrToPointerRecordTestCase{
+		name:            "_http._tcp.local.",
+		expectedService: "_http._tcp.local.",
+		expectedSubtype: "",
+	}
+
+	testCase.run(t)
+}
+
+func TestPtrToPointerRecordSubtype(t *testing.T) {
+	testCase := ptrToPointerRecordTestCase{
+		name:            "_printer._sub._http._tcp.local.",
+		expectedService: "_http._tcp.local.",
+		expectedSubtype: "_printer",
+	}
+
+	testCase.run(t)
+}
+
+func TestSrvToServiceRecordEscapedInstanceName(t *testing.T) {
+	srv := &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   `Living\ Room\.v2._http._tcp.local.`,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		Port:   8080,
+		Target: "test_host.local.",
+	}
+
+	record, ok := srvToServiceRecord(srv)
+
+	assert.True(t, ok)
+	assert.Equal(t, serviceInstanceName(`Living\ Room\.v2._http._tcp.local.`), record.instanceName)
+	assert.Equal(t, serviceName("_http._tcp.local."), record.serviceName)
+}
+
+func TestMessagePipelineCloseUndelivered(t *testing.T) {
+	pipeline := newMessagePipeline()
+	msgCh := make(chan ReceivedMessage)
+
+	doneCh := make(chan struct{})
+	go func() {
+		pipeline.pipeMessages(msgCh)
+		close(doneCh)
+	}()
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{newTestPointerAnswer("a")}
+	msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: msg}
+
+	// The answers are never received, which must not keep the pipeline from shutting down
+	pipeline.close()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline did not shut down")
+	}
+}
+
+func TestOnMessageReceivedGenericRecords(t *testing.T) {
+	pipeline := newMessagePipeline()
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.HINFO{
+			Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 120},
+			Cpu: "ARM",
+			Os:  "Linux",
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+			Txt: []string{"model=laser"},
+		},
+	}
+	msg.SetEdns0(1440, false)
+
+	go pipeline.onMessageReceived(ReceivedMessage{InterfaceIndex: 1, Msg: msg})
+	answers := <-pipeline.answerCh
+
+	// TXT records of names that are not service instances are kept as generic records, OPT records dropped
+	assert.Empty(t, answers.textRecords)
+	assert.Len(t, answers.genericRecords, 2)
+	assert.Equal(t, questionType(dns.TypeHINFO), answers.genericRecords[0].getQuestionType())
+	assert.Equal(t, questionTypeText, answers.genericRecords[1].getQuestionType())
+	assert.Equal(t, 120*time.Second, answers.genericRecords[0].remainingTimeToLive)
+}
+
+func TestOnMessageReceivedKnownAnswersOnly(t *testing.T) {
+	pipeline := newMessagePipeline()
+
+	// Continuation of a truncated query, which carries only known answers
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{newTestPointerAnswer("a")}
+
+	go pipeline.onMessageReceived(ReceivedMessage{InterfaceIndex: 1, Msg: msg})
+	query := <-pipeline.queryCh
+
+	assert.Empty(t, query.questions)
+	assert.Equal(t, msg.Answer, query.knownAnswers)
+}
+
+func TestOnMessageReceivedReversePointer(t *testing.T) {
+	pipeline := newMessagePipeline()
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: "10.1.168.192.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+			Ptr: "printer.local.",
+		},
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: "_http._tcp.local.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 4500},
+			Ptr: "printer._http._tcp.local.",
+		},
+	}
+
+	go pipeline.onMessageReceived(ReceivedMessage{InterfaceIndex: 1, Msg: msg})
+	answers := <-pipeline.answerCh
+
+	// Reverse mapping pointers are kept apart from service pointers
+	assert.Len(t, answers.pointerRecords, 1)
+	assert.Equal(t, serviceName("_http._tcp.local."), answers.pointerRecords[0].serviceName)
+	assert.Len(t, answers.genericRecords, 1)
+	assert.Equal(t, "10.1.168.192.in-addr.arpa.", answers.genericRecords[0].getName())
+}
+
+func (tc *ptrToPointerRecordTestCase) run(t *testing.T) {
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   tc.name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		Ptr: "test instance._http._tcp.local.",
+	}
+
+	record := ptrToPointerRecord(ptr)
+
+	assert.Equal(t, tc.expectedService, record.serviceName)
+	assert.Equal(t, tc.expectedSubtype, record.subtype)
+	assert.Equal(t, serviceName(tc.name), record.getName())
+}
+
+type txtToTextRecordTestCase struct {
+	txt            []string
+	expectedRaw    [][]byte
+	expectedValues map[string]string
+}
+
+func TestTxtToTextRecord(t *testing.T) {
+	testCase := txtToTextRecordTestCase{
+		txt: []string{"path=/", "version=2"},
+		expectedRaw: [][]byte{
+			[]byte("path=/"),
+			[]byte("version=2"),
+		},
+		expectedValues: map[string]string{
+			"path":    "/",
+			"version": "2",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestTxtToTextRecordBinaryValue(t *testing.T) {
+	testCase := txtToTextRecordTestCase{
+		txt: []string{`id=\000\255\\`},
+		expectedRaw: [][]byte{
+			{'i', 'd', '=', 0, 255, '\\'},
+		},
+		expectedValues: map[string]string{
+			"id": "\x00\xff\\",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestTxtToTextRecordBooleanAndEmptyValues(t *testing.T) {
+	testCase := txtToTextRecordTestCase{
+		txt: []string{"color", "duplex=", ""},
+		expectedRaw: [][]byte{
+			[]byte("color"),
+			[]byte("duplex="),
+			[]byte(""),
+		},
+		expectedValues: map[string]string{
+			"color":  "",
+			"duplex": "",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestTxtToTextRecordDuplicateKeys(t *testing.T) {
+	testCase := txtToTextRecordTestCase{
+		txt: []string{"Key=first", "KEY=second", "=no key"},
+		expectedRaw: [][]byte{
+			[]byte("Key=first"),
+			[]byte("KEY=second"),
+			[]byte("=no key"),
+		},
+		expectedValues: map[string]string{
+			"key": "first",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestTxtToTextRecordValueContainsEquals(t *testing.T) {
+	testCase := txtToTextRecordTestCase{
+		txt: []string{"token=aGVsbG8=="},
+		expectedRaw: [][]byte{
+			[]byte("token=aGVsbG8=="),
+		},
+		expectedValues: map[string]string{
+			"token": "aGVsbG8==",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func (tc *txtToTextRecordTestCase) run(t *testing.T) {
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   "test instance._http._tcp.local.",
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		Txt: tc.txt,
+	}
+
+	record, ok := txtToTextRecord(txt)
+
+	assert.True(t, ok)
+	assert.Equal(t, tc.expectedRaw, record.raw)
+	assert.Equal(t, tc.expectedValues, record.values)
+}
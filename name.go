@@ -0,0 +1,134 @@
+package dnssd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// InstanceName is the name of a service instance split into its parts (RFC 6763 Section 4.1).
+type InstanceName struct {
+	Instance string // User-friendly instance name without escapes, e.g. "Living Room.v2"
+	Service  string // Application and transport protocol, e.g. "_http._tcp"
+	Domain   string // Domain in which the instance is registered, e.g. "local."
+}
+
+// ParseInstanceName parses the given service instance name in presentation format, such as
+// "Living\ Room\.v2._http._tcp.local.", into its parts. The service is identified by its transport
+// protocol label, so unescaped dots within the instance portion of the name are also accepted.
+func ParseInstanceName(name string) (InstanceName, error) {
+	labels, err := splitLabels(name)
+	if err != nil {
+		return InstanceName{}, err
+	}
+
+	// The instance portion must contain at least one label and the domain must contain at least one label.
+	for i := 1; i+2 < len(labels); i++ {
+		if !strings.HasPrefix(labels[i], "_") || !isTransportProtocolLabel(labels[i+1]) {
+			continue
+		}
+
+		domainLabels := make([]string, 0, len(labels)-i-2)
+		for _, label := range labels[i+2:] {
+			domainLabels = append(domainLabels, labelEscape(label))
+		}
+
+		return InstanceName{
+			Instance: strings.Join(labels[:i], "."),
+			Service:  labelEscape(labels[i]) + "." + labels[i+1],
+			Domain:   strings.Join(domainLabels, ".") + ".",
+		}, nil
+	}
+
+	return InstanceName{}, fmt.Errorf("dnssd: %q is not a service instance name", name)
+}
+
+// String returns the instance name in presentation format, with the instance portion escaped so that it
+// forms a single label.
+func (n InstanceName) String() string {
+	return labelEscape(n.Instance) + "." + n.getServiceName().String()
+}
+
+// getServiceName returns the name of the service the instance belongs to, e.g. "_http._tcp.local.".
+func (n InstanceName) getServiceName() serviceName {
+	return serviceName(n.Service + "." + dns.Fqdn(n.Domain))
+}
+
+// toServiceInstanceName converts the given service instance name, in presentation format or with the
+// instance portion unescaped, into the escaped presentation format under which instances are cached.
+func toServiceInstanceName(name string) (serviceInstanceName, error) {
+	parsed, err := ParseInstanceName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return serviceInstanceName(parsed.String()), nil
+}
+
+// isReverseMappingName returns true if the given name is an address's name in the "in-addr.arpa." or
+// "ip6.arpa." domains used to look up the host name for an address (RFC 6762 Section 4).
+func isReverseMappingName(name string) bool {
+	lowerName := strings.ToLower(name)
+	return strings.HasSuffix(lowerName, ".in-addr.arpa.") || strings.HasSuffix(lowerName, ".ip6.arpa.")
+}
+
+// isTransportProtocolLabel returns true if the given label is one of the protocol labels that complete a
+// service name (RFC 6763 Section 7).
+func isTransportProtocolLabel(label string) bool {
+	return strings.EqualFold(label, "_tcp") || strings.EqualFold(label, "_udp")
+}
+
+// splitLabels splits the given domain name in presentation format into its labels, removing all escapes.
+func splitLabels(name string) ([]string, error) {
+	labels := make([]string, 0)
+	label := make([]byte, 0, len(name))
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '.':
+			if len(label) == 0 {
+				return nil, fmt.Errorf("dnssd: %q contains an empty label", name)
+			}
+
+			labels = append(labels, string(label))
+			label = label[:0]
+
+		case c != '\\':
+			label = append(label, c)
+
+		case i+3 < len(name) && isDigits(name[i+1:i+4]):
+			value := int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+			if value > 255 {
+				return nil, fmt.Errorf("dnssd: %q contains an invalid escape sequence", name)
+			}
+
+			label = append(label, byte(value))
+			i += 3
+
+		case i+1 < len(name):
+			label = append(label, name[i+1])
+			i++
+
+		default:
+			return nil, fmt.Errorf("dnssd: %q ends with an incomplete escape sequence", name)
+		}
+	}
+
+	if len(label) > 0 {
+		labels = append(labels, string(label))
+	}
+
+	return labels, nil
+}
+
+// isDigits returns true if the given string consists only of decimal digits.
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,120 @@
+package dnssd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parseInstanceNameTestCase struct {
+	name          string
+	expectedName  InstanceName
+	expectedError bool
+}
+
+func TestParseInstanceName(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name: "Living Room._http._tcp.local.",
+		expectedName: InstanceName{
+			Instance: "Living Room",
+			Service:  "_http._tcp",
+			Domain:   "local.",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameDecimalEscape(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name: `K\195\188che._ipp._tcp.local.`,
+		expectedName: InstanceName{
+			Instance: "Küche",
+			Service:  "_ipp._tcp",
+			Domain:   "local.",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameEscapedDots(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name: `Living\ Room\.v2\\._http._tcp.local.`,
+		expectedName: InstanceName{
+			Instance: `Living Room.v2\`,
+			Service:  "_http._tcp",
+			Domain:   "local.",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameInvalidEscape(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name:          `Living Room\`,
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameMissingDomain(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name:          "Living Room._http._tcp",
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameMissingInstance(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name:          "_http._tcp.local.",
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestParseInstanceNameUnescapedDots(t *testing.T) {
+	testCase := parseInstanceNameTestCase{
+		name: "Living Room.v2._http._tcp.local.",
+		expectedName: InstanceName{
+			Instance: "Living Room.v2",
+			Service:  "_http._tcp",
+			Domain:   "local.",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestInstanceNameString(t *testing.T) {
+	name := InstanceName{
+		Instance: "Living Room.v2",
+		Service:  "_http._tcp",
+		Domain:   "local",
+	}
+
+	assert.Equal(t, `Living\ Room\.v2._http._tcp.local.`, name.String())
+}
+
+func TestIsReverseMappingName(t *testing.T) {
+	assert.True(t, isReverseMappingName("10.1.168.192.in-addr.arpa."))
+	assert.True(t, isReverseMappingName("0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.IP6.ARPA."))
+	assert.False(t, isReverseMappingName("_http._tcp.local."))
+}
+
+func (tc *parseInstanceNameTestCase) run(t *testing.T) {
+	name, err := ParseInstanceName(tc.name)
+
+	if tc.expectedError {
+		assert.Error(t, err)
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, tc.expectedName, name)
+}
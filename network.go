@@ -20,6 +20,10 @@ const (
 	mdnsPort   = 5353
 	mdnsIPv4IP = "224.0.0.251"
 	mdnsIPv6IP = "FF02::FB"
+
+	// maxQuerySize is the largest query message sent before known answers are split over multiple
+	// packets: a 1500 byte Ethernet MTU less the IPv6 and UDP headers (RFC 6762 Section 17).
+	maxQuerySize = 1452
 )
 
 var (
@@ -34,17 +38,27 @@ var (
 	}
 )
 
-// netClient provides access to sending and receiving network messages.
+// netClient provides access to sending network messages over the resolver's transport.
 type netClient struct {
-	multicastConns []udpConnection
-	unicastConns   []udpConnection
+	transport Transport
 }
 
 // udpConnection represents a single UDP connection.
 type udpConnection struct {
-	conn       *net.UDPConn
-	network    udpNetwork
-	shutdownCh chan struct{}
+	conn           *net.UDPConn
+	interfaceIndex int
+	network        udpNetwork
+	shutdownCh     chan struct{}
+}
+
+// udpTransport is the default transport, sending and receiving messages over UDP sockets. All messages
+// are sent from the multicast sockets on the mDNS port (RFC 6762 Section 5.2). Only transports for one-shot
+// queries have no multicast sockets and send from unicast sockets on ephemeral ports instead.
+type udpTransport struct {
+	addresses      []net.IP
+	msgCh          chan ReceivedMessage
+	multicastConns []udpConnection
+	unicastConns   []udpConnection
 }
 
 // interfaceGetAddresses returns all IP addresses for the given interface.
@@ -66,31 +80,51 @@ func interfaceGetAddresses(ifi net.Interface) ([]net.IP, error) {
 	return interfaceIPs, err
 }
 
-// newNetClient creates a new network client listening for DNS messages on the specified interfaces
-// and address families.
-func newNetClient(addrFamily AddrFamily, interfaces []net.Interface, msgCh chan<- dns.Msg) (client netClient, err error) {
-	var unicastConns, multicastConns []udpConnection
+// interfacesGetAddresses returns all IP addresses of the given address family assigned to the given
+// interfaces.
+func interfacesGetAddresses(addrFamily AddrFamily, interfaces []net.Interface) ([]net.IP, error) {
+	addresses := make([]net.IP, 0)
 
-	unicastConns, err = unicastConnectionsCreate(addrFamily, interfaces, msgCh)
-	if err != nil {
-		return
+	for _, ifi := range interfaces {
+		ipAddrs, err := interfaceGetAddresses(ifi)
+		if err != nil {
+			return addresses, err
+		}
+
+		for _, addr := range ipAddrs {
+			isIPv4 := addr.To4() != nil
+			if (isIPv4 && addrFamily.includesIPv4()) || (!isIPv4 && addrFamily.includesIPv6()) {
+				addresses = append(addresses, addr)
+			}
+		}
 	}
 
-	multicastConns, err = multicastConnectionsCreate(addrFamily, interfaces, msgCh)
+	return addresses, nil
+}
+
+// NewUDPTransport creates the default transport, listening for mDNS messages on the specified interfaces
+// and address families.
+func NewUDPTransport(addrFamily AddrFamily, interfaces []net.Interface) (Transport, error) {
+	t := &udpTransport{
+		msgCh: make(chan ReceivedMessage),
+	}
+
+	var err error
+	t.addresses, err = interfacesGetAddresses(addrFamily, interfaces)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	client = netClient{
-		multicastConns: multicastConns,
-		unicastConns:   unicastConns,
+	t.multicastConns, err = multicastConnectionsCreate(addrFamily, interfaces, t.msgCh)
+	if err != nil {
+		return nil, err
 	}
 
-	return
+	return t, nil
 }
 
 // multicastConnectionsCreate creates all multicast connections.
-func multicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interface, msgCh chan<- dns.Msg) (conns []udpConnection, err error) {
+func multicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interface, msgCh chan<- ReceivedMessage) (conns []udpConnection, err error) {
 	conns = make([]udpConnection, 0)
 
 	for _, ifi := range interfaces {
@@ -120,20 +154,14 @@ func multicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interfac
 
 // newMulticastConnection creates a new multicast connection on the given network and interface.
 // all received messages will be sent to the provided message channel.
-func newMulticastConnection(network udpNetwork, ifi *net.Interface, msgCh chan<- dns.Msg) (conn udpConnection, err error) {
+func newMulticastConnection(network udpNetwork, ifi *net.Interface, msgCh chan<- ReceivedMessage) (conn udpConnection, err error) {
 	conn = udpConnection{
-		network:    network,
-		shutdownCh: make(chan struct{}),
-	}
-
-	var groupAddr *net.UDPAddr
-	if network == ipv4UDPNetwork {
-		groupAddr = &mdnsIPv4Addr
-	} else {
-		groupAddr = &mdnsIPv6Addr
+		interfaceIndex: ifi.Index,
+		network:        network,
+		shutdownCh:     make(chan struct{}),
 	}
 
-	conn.conn, err = net.ListenMulticastUDP(string(network), ifi, groupAddr)
+	conn.conn, err = net.ListenMulticastUDP(string(network), ifi, conn.groupAddr())
 	if err != nil {
 		err = fmt.Errorf("dnssd: failed creating multicast connection on network %v interface %v: %v", network, ifi, err)
 		return
@@ -144,12 +172,13 @@ func newMulticastConnection(network udpNetwork, ifi *net.Interface, msgCh chan<-
 	return
 }
 
-// newUnicastConnection creates a new unicast UDP connection on the specified network. All
+// newUnicastConnection creates a new unicast UDP connection on the specified network and interface. All
 // received messages will be written to the given channel.
-func newUnicastConnection(network udpNetwork, interfaceIP net.IP, msgCh chan<- dns.Msg) (conn udpConnection, err error) {
+func newUnicastConnection(network udpNetwork, ifi *net.Interface, interfaceIP net.IP, msgCh chan<- ReceivedMessage) (conn udpConnection, err error) {
 	conn = udpConnection{
-		network:    network,
-		shutdownCh: make(chan struct{}),
+		interfaceIndex: ifi.Index,
+		network:        network,
+		shutdownCh:     make(chan struct{}),
 	}
 
 	conn.conn, err = net.ListenUDP(string(network), &net.UDPAddr{IP: interfaceIP})
@@ -164,7 +193,7 @@ func newUnicastConnection(network udpNetwork, interfaceIP net.IP, msgCh chan<- d
 }
 
 // unicastConnectionsCreate creates all unicast connections.
-func unicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interface, msgCh chan<- dns.Msg) ([]udpConnection, error) {
+func unicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interface, msgCh chan<- ReceivedMessage) ([]udpConnection, error) {
 	conns := make([]udpConnection, 0)
 
 	for _, ifi := range interfaces {
@@ -175,14 +204,14 @@ func unicastConnectionsCreate(addrFamily AddrFamily, interfaces []net.Interface,
 
 		for _, addr := range ipAddrs {
 			if addrFamily.includesIPv4() && addr.To4() != nil {
-				conn, err := newUnicastConnection(ipv4UDPNetwork, addr, msgCh)
+				conn, err := newUnicastConnection(ipv4UDPNetwork, &ifi, addr, msgCh)
 				if err != nil {
 					return conns, err
 				}
 
 				conns = append(conns, conn)
 			} else if addrFamily.includesIPv6() {
-				conn, err := newUnicastConnection(ipv6UDPNetwork, addr, msgCh)
+				conn, err := newUnicastConnection(ipv6UDPNetwork, &ifi, addr, msgCh)
 				if err != nil {
 					return conns, err
 				}
@@ -205,73 +234,185 @@ func (a AddrFamily) includesIPv6() bool {
 	return (a == AddrFamilyIPv6) || (a == AddrFamilyAll)
 }
 
-// close closes the network client.
+// close closes the network client's transport.
 func (c *netClient) close() {
-	for _, conn := range c.multicastConns {
-		conn.close()
+	err := c.transport.Close()
+	if err != nil {
+		log.Printf("dnssd: failed closing transport: %v", err)
 	}
+}
 
-	for _, conn := range c.unicastConns {
-		conn.close()
+// sendResponse multicasts the given response message from the mDNS port on all interfaces.
+func (c *netClient) sendResponse(msg *dns.Msg) error {
+	return c.transport.Send(msg, nil)
+}
+
+// sendResponseTo sends the given response message directly to the specified address from the
+// mDNS port.
+func (c *netClient) sendResponseTo(msg *dns.Msg, addr *net.UDPAddr) error {
+	return c.transport.Send(msg, addr)
+}
+
+// sendProbe sends a probe containing the given questions and the records being claimed in its
+// authority section (RFC 6762 Section 8.1).
+func (c *netClient) sendProbe(questions []question, authorities []dns.RR) error {
+	message := questionsToMessage(questions)
+	message.Ns = authorities
+
+	return c.sendQuery(message)
+}
+
+// sendQueryTo sends the given query message directly to the specified address from the mDNS port.
+func (c *netClient) sendQueryTo(message *dns.Msg, addr *net.UDPAddr) error {
+	return c.transport.Send(message, addr)
+}
+
+// sendQuery multicasts the given query message on all interfaces.
+func (c *netClient) sendQuery(message *dns.Msg) error {
+	return c.transport.Send(message, nil)
+}
+
+// sendQuestions sends the given set of questions along with the answers already known for them. If the
+// known answers do not fit into a single packet, they are spread over multiple packets (RFC 6762
+// Section 7.2).
+func (c *netClient) sendQuestions(questions []question, knownAnswers []dns.RR) error {
+	for _, message := range questionsToMessages(questions, knownAnswers) {
+		err := c.sendQuery(message)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-// sendQuestion sends the given question.
-func (c *netClient) sendQuestion(q question) error {
-	return c.sendQuestions([]question{q})
+// questionsToMessages creates the query messages containing the given questions and known answers. The
+// first message contains all questions and each message is filled with as many known answers as fit.
+// All messages but the last have the truncated bit set to indicate that more known answers follow.
+func questionsToMessages(questions []question, knownAnswers []dns.RR) []*dns.Msg {
+	message := questionsToMessage(questions)
+	messages := []*dns.Msg{message}
+
+	for _, answer := range knownAnswers {
+		message.Answer = append(message.Answer, answer)
+
+		if message.Len() > maxQuerySize && len(message.Answer) > 1 {
+			message.Answer = message.Answer[:len(message.Answer)-1]
+			message.Truncated = true
+
+			message = &dns.Msg{
+				Answer: []dns.RR{answer},
+			}
+
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
 }
 
-// sendQuestions sends the given set questions.
-func (c *netClient) sendQuestions(questions []question) error {
+// questionsToMessage creates a query message containing the given questions.
+func questionsToMessage(questions []question) *dns.Msg {
 	dnsQuestions := make([]dns.Question, 0, len(questions))
 	for i := range questions {
 		dnsQuestions = append(dnsQuestions, questions[i].toDNSQuestion())
 	}
 
-	message := dns.Msg{
+	return &dns.Msg{
 		Question: dnsQuestions,
 	}
+}
+
+// Close closes all of the transport's connections.
+func (t *udpTransport) Close() error {
+	for _, conn := range t.multicastConns {
+		conn.close()
+	}
 
-	data, err := message.Pack()
+	for _, conn := range t.unicastConns {
+		conn.close()
+	}
+
+	return nil
+}
+
+// Addresses returns the addresses of the interfaces the transport sends and receives messages on.
+func (t *udpTransport) Addresses() []net.IP {
+	return t.addresses
+}
+
+// Receive returns the channel on which messages received on any of the transport's connections are
+// delivered.
+func (t *udpTransport) Receive() <-chan ReceivedMessage {
+	return t.msgCh
+}
+
+// Send sends the given message to the given address, or multicasts it on all interfaces if the address
+// is nil. Messages are sent from the multicast connections so that they originate from the mDNS port, or
+// from the unicast connections of a transport for one-shot queries.
+func (t *udpTransport) Send(msg *dns.Msg, dst *net.UDPAddr) error {
+	data, err := msg.Pack()
 	if err != nil {
 		return err
 	}
 
-	for _, conn := range c.unicastConns {
-		var groupAddr *net.UDPAddr
-		if conn.network == ipv4UDPNetwork {
-			groupAddr = &mdnsIPv4Addr
-		} else {
-			groupAddr = &mdnsIPv6Addr
+	conns := t.multicastConns
+	if len(conns) == 0 {
+		conns = t.unicastConns
+	}
+
+	if dst == nil {
+		for _, conn := range conns {
+			_, err := conn.conn.WriteToUDP(data, conn.groupAddr())
+			if err != nil {
+				return err
+			}
 		}
 
-		_, err := conn.conn.WriteToUDP(data, groupAddr)
-		if err != nil {
+		return nil
+	}
+
+	network := ipv4UDPNetwork
+	if dst.IP.To4() == nil {
+		network = ipv6UDPNetwork
+	}
+
+	for _, conn := range conns {
+		if conn.network == network {
+			_, err := conn.conn.WriteToUDP(data, dst)
 			return err
 		}
 	}
 
-	return nil
+	return fmt.Errorf("dnssd: no connection available to send to %v", dst)
 }
 
-// close closes the connection.
+// close closes the connection. The shutdown channel is closed first so that the listener sees it once
+// its pending read fails.
 func (c *udpConnection) close() {
-	go func() {
-		c.conn.Close()
-		c.shutdownCh <- struct{}{}
-	}()
+	close(c.shutdownCh)
+	c.conn.Close()
+}
+
+// groupAddr returns the mDNS multicast group address for the connection's network.
+func (c *udpConnection) groupAddr() *net.UDPAddr {
+	if c.network == ipv4UDPNetwork {
+		return &mdnsIPv4Addr
+	}
+
+	return &mdnsIPv6Addr
 }
 
 // listen listens for DNS messages on the UDP connection writing received messages to the
 // provided channel.
-func (c *udpConnection) listen(msgCh chan<- dns.Msg) {
+func (c *udpConnection) listen(msgCh chan<- ReceivedMessage) {
 	const (
 		maxPacketSize = 9000 // Defined in RFC 6762 Section 17
 	)
 
 	readBuf := make([]byte, maxPacketSize)
 	for {
-		bytesRead, err := c.conn.Read(readBuf)
+		bytesRead, source, err := c.conn.ReadFromUDP(readBuf)
 
 		// Check to see if we have been told to shutdown while we were waiting
 		select {
@@ -285,41 +426,38 @@ func (c *udpConnection) listen(msgCh chan<- dns.Msg) {
 			continue
 		}
 
-		msg := dns.Msg{}
+		msg := new(dns.Msg)
 		err = msg.Unpack(readBuf[:bytesRead])
 		if err != nil {
 			log.Printf("dnssd: failed parsing DNS packet: %v", err)
 			continue
 		}
 
-		msgCh <- msg
+		received := ReceivedMessage{
+			InterfaceIndex: c.interfaceIndex,
+			Msg:            msg,
+			Source:         source,
+		}
+
+		// Nobody may be receiving any longer once we have been told to shutdown
+		select {
+		case msgCh <- received:
+		case <-c.shutdownCh:
+			return
+		}
 	}
 }
 
 // toDNSQuestion converts the question into the corresponding DNS question.
 func (q *question) toDNSQuestion() dns.Question {
-	var qType uint16
-
-	switch q.questionType {
-	case questionTypeIPv4Address:
-		qType = dns.TypeA
-
-	case questionTypeIPv6Address:
-		qType = dns.TypeAAAA
-
-	case questionTypePointer:
-		qType = dns.TypePTR
-
-	case questionTypeService:
-		qType = dns.TypeSRV
-
-	case questionTypeText:
-		qType = dns.TypeTXT
+	class := uint16(dns.ClassINET)
+	if q.unicastResponse {
+		class |= 1 << unicastResponseBit
 	}
 
 	return dns.Question{
 		Name:   q.name,
-		Qtype:  qType,
-		Qclass: dns.ClassINET,
+		Qtype:  uint16(q.questionType),
+		Qclass: class,
 	}
 }
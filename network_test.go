@@ -0,0 +1,143 @@
+package dnssd
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuestionsToMessagesSingle(t *testing.T) {
+	questions := []question{{name: "_http._tcp.local.", questionType: questionTypePointer}}
+	knownAnswers := newKnownAnswers(3)
+
+	messages := questionsToMessages(questions, knownAnswers)
+
+	assert.Len(t, messages, 1)
+	assert.False(t, messages[0].Truncated)
+	assert.Equal(t, []dns.Question{questions[0].toDNSQuestion()}, messages[0].Question)
+	assert.Equal(t, knownAnswers, messages[0].Answer)
+}
+
+func TestQuestionsToMessagesSplit(t *testing.T) {
+	questions := []question{{name: "_http._tcp.local.", questionType: questionTypePointer}}
+	knownAnswers := newKnownAnswers(100)
+
+	messages := questionsToMessages(questions, knownAnswers)
+	assert.True(t, len(messages) > 1)
+
+	var answers []dns.RR
+	for i, message := range messages {
+		assert.True(t, message.Len() <= maxQuerySize)
+
+		// Only the first message contains the questions and only the last is not truncated
+		assert.Equal(t, i == 0, len(message.Question) > 0)
+		assert.Equal(t, i < len(messages)-1, message.Truncated)
+
+		answers = append(answers, message.Answer...)
+	}
+
+	assert.Equal(t, knownAnswers, answers)
+}
+
+func TestQuestionToDNSQuestionUnicastResponse(t *testing.T) {
+	q := question{name: "_http._tcp.local.", questionType: questionTypePointer, unicastResponse: true}
+
+	dnsQuestion := q.toDNSQuestion()
+	assert.Equal(t, uint16(dns.ClassINET|1<<unicastResponseBit), dnsQuestion.Qclass)
+
+	parsed, ok := dnsQuestionToQuestion(&dnsQuestion)
+	assert.True(t, ok)
+	assert.Equal(t, q, parsed)
+}
+
+func TestQuestionToDNSQuestionOtherType(t *testing.T) {
+	q := question{name: "printer.local.", questionType: questionType(dns.TypeHINFO)}
+
+	dnsQuestion := q.toDNSQuestion()
+	assert.Equal(t, dns.TypeHINFO, dnsQuestion.Qtype)
+
+	parsed, ok := dnsQuestionToQuestion(&dnsQuestion)
+	assert.True(t, ok)
+	assert.Equal(t, q, parsed)
+}
+
+func TestUDPConnectionCloseWhileDelivering(t *testing.T) {
+	msgCh := make(chan ReceivedMessage)
+
+	conn, err := newUnicastConnection(ipv4UDPNetwork, &net.Interface{Index: 1}, net.IPv4(127, 0, 0, 1), msgCh)
+	if err != nil {
+		t.Skipf("loopback unavailable: %v", err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, conn.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	query, err := questionsToMessage([]question{{name: "_http._tcp.local.", questionType: questionTypePointer}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sender.Write(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody receives the message, so the listener blocks delivering it
+	assert.Eventually(t, func() bool {
+		stacks := listenerStacks()
+		return stacks != "" && !strings.Contains(stacks, "ReadFromUDP")
+	}, time.Second, 10*time.Millisecond)
+
+	conn.close()
+
+	assert.Eventually(t, func() bool {
+		return countListeners() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newKnownAnswers creates the given number of pointer records to use as known answers.
+func newKnownAnswers(count int) []dns.RR {
+	knownAnswers := make([]dns.RR, 0, count)
+	for i := 0; i < count; i++ {
+		knownAnswers = append(knownAnswers, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   "_http._tcp.local.",
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    4500,
+			},
+			Ptr: fmt.Sprintf("Instance %d._http._tcp.local.", i),
+		})
+	}
+
+	return knownAnswers
+}
+
+// countListeners returns the number of goroutines listening on UDP connections.
+func countListeners() int {
+	return strings.Count(listenerStacks(), "(*udpConnection).listen(")
+}
+
+// listenerStacks returns the stacks of all goroutines listening on UDP connections.
+func listenerStacks() string {
+	buf := make([]byte, 1<<20)
+	goroutines := strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n")
+
+	var stacks []string
+	for _, goroutine := range goroutines {
+		if strings.Contains(goroutine, "(*udpConnection).listen(") {
+			stacks = append(stacks, goroutine)
+		}
+	}
+
+	return strings.Join(stacks, "\n\n")
+}
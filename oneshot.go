@@ -0,0 +1,142 @@
+package dnssd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// QueryOnce performs a one-shot query for instances of the given service on the specified interface,
+// collecting responses until the context is done and returning all instances resolved by then (RFC 6762
+// Section 5.1). Queries are sent from ephemeral ports, so responders answer with conventional unicast
+// responses and the mDNS port does not need to be bound. This allows discovering services where another
+// mDNS daemon owns the port or the process lacks the privileges to bind it.
+func QueryOnce(ctx context.Context, iface net.Interface, serviceName string) ([]ServiceInstance, error) {
+	t := &udpTransport{
+		msgCh: make(chan ReceivedMessage),
+	}
+
+	var err error
+	t.unicastConns, err = unicastConnectionsCreate(AddrFamilyAll, []net.Interface{iface}, t.msgCh)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	if len(t.unicastConns) == 0 {
+		return nil, fmt.Errorf("dnssd: interface %v has no addresses to query from", iface.Name)
+	}
+
+	return queryOnce(ctx, t, serviceName)
+}
+
+// queryOnce performs a one-shot query for instances of the given service over the given transport, which
+// is closed once the context is done.
+func queryOnce(ctx context.Context, transport Transport, name string) ([]ServiceInstance, error) {
+	messagePipeline := newMessagePipeline()
+	defer messagePipeline.close()
+
+	// Close the transport before the pipeline so that its listeners are not left sending to nobody
+	netClient := netClient{transport: transport}
+	defer netClient.close()
+
+	go messagePipeline.pipeMessages(transport.Receive())
+
+	cache := newCache()
+	browseSet := map[serviceName]bool{serviceName(name): true}
+
+	pointerQuestion := question{
+		name:         name,
+		questionType: questionTypePointer,
+	}
+
+	askedQuestions := map[question]bool{pointerQuestion: true}
+
+	err := sendOneShotQuestions(netClient, []question{pointerQuestion})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return oneShotResults(&cache, serviceName(name)), nil
+
+		case <-messagePipeline.queryCh:
+			// We do not answer queries in one-shot mode
+
+		case answers := <-messagePipeline.answerCh:
+			for _, record := range answers.addressRecords {
+				cache.onAddressRecordReceived(record)
+			}
+
+			for _, record := range answers.pointerRecords {
+				cache.onPointerRecordReceived(record)
+			}
+
+			for _, record := range answers.serviceRecords {
+				cache.onServiceRecordReceived(record)
+			}
+
+			for _, record := range answers.textRecords {
+				cache.onTextRecordReceived(record)
+			}
+
+			// Ask once for any records the responses did not include
+			missingQuestions := make(map[question]bool)
+			cache.getQuestionsForMissingRecords(browseSet, missingQuestions)
+
+			var questions []question
+			for q := range missingQuestions {
+				if !askedQuestions[q] {
+					askedQuestions[q] = true
+					questions = append(questions, q)
+				}
+			}
+
+			if len(questions) == 0 {
+				continue
+			}
+
+			err := sendOneShotQuestions(netClient, questions)
+			if err != nil {
+				log.Printf("dnssd: failed sending one-shot questions: %v", err)
+			}
+		}
+	}
+}
+
+// oneShotResults returns the instances of the given service resolved from the cache, ordered by
+// instance name and address.
+func oneShotResults(c *cache, name serviceName) []ServiceInstance {
+	instances := make([]ServiceInstance, 0)
+	for _, instance := range c.toResolvedInstances() {
+		if instance.isInstanceOf(name) {
+			instances = append(instances, instance)
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].InstanceName != instances[j].InstanceName {
+			return instances[i].InstanceName < instances[j].InstanceName
+		}
+
+		return bytes.Compare(instances[i].Address, instances[j].Address) < 0
+	})
+
+	return instances
+}
+
+// sendOneShotQuestions sends a one-shot query containing the given questions. Responders echo the
+// query's ID in their unicast responses (RFC 6762 Section 6.7).
+func sendOneShotQuestions(c netClient, questions []question) error {
+	message := questionsToMessage(questions)
+	message.Id = dns.Id()
+
+	return c.sendQuery(message)
+}
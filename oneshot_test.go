@@ -0,0 +1,162 @@
+package dnssd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryOnce(t *testing.T) {
+	transport := newMockTransport()
+	source := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: mdnsPort}
+
+	go func() {
+		query := (<-transport.sentCh).msg
+		assert.Equal(t, "_http._tcp.local.", query.Question[0].Name)
+		assert.NotEqual(t, uint16(0), query.Id)
+
+		// Answer only with the pointer record so that the remaining records must be asked for
+		response := newOneShotResponse(query.Id, &dns.PTR{
+			Hdr: newOneShotHeader("_http._tcp.local.", dns.TypePTR),
+			Ptr: "test._http._tcp.local.",
+		})
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response, Source: source}
+
+		query = (<-transport.sentCh).msg
+		assert.ElementsMatch(t, []dns.Question{
+			{Name: "test._http._tcp.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+			{Name: "test._http._tcp.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+		}, query.Question)
+
+		response = newOneShotResponse(query.Id,
+			&dns.SRV{
+				Hdr:    newOneShotHeader("test._http._tcp.local.", dns.TypeSRV),
+				Port:   8080,
+				Target: "test-host.local.",
+			},
+			&dns.TXT{
+				Hdr: newOneShotHeader("test._http._tcp.local.", dns.TypeTXT),
+				Txt: []string{"path=/"},
+			},
+			&dns.A{
+				Hdr: newOneShotHeader("test-host.local.", dns.TypeA),
+				A:   net.ParseIP("10.0.0.1").To4(),
+			},
+		)
+		transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response, Source: source}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	instances, err := queryOnce(ctx, transport, "_http._tcp.local.")
+	assert.NoError(t, err)
+	assert.Equal(t, []ServiceInstance{
+		{
+			Address:        net.ParseIP("10.0.0.1").To4(),
+			InstanceName:   "test._http._tcp.local.",
+			Port:           8080,
+			ServiceName:    "_http._tcp.local.",
+			TextRecords:    map[string]string{"path": "/"},
+			TextRecordsRaw: [][]byte{[]byte("path=/")},
+		},
+	}, instances)
+	assert.True(t, transport.closed)
+}
+
+func TestQueryOnceNoResponses(t *testing.T) {
+	transport := newMockTransport()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	instances, err := queryOnce(ctx, transport, "_http._tcp.local.")
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+}
+
+func TestQueryOnceStopsListenersWhilePacketsArrive(t *testing.T) {
+	transport := &udpTransport{
+		msgCh: make(chan ReceivedMessage),
+	}
+
+	conn, err := newUnicastConnection(ipv4UDPNetwork, &net.Interface{Index: 1}, net.IPv4(127, 0, 0, 1), transport.msgCh)
+	if err != nil {
+		t.Skipf("loopback unavailable: %v", err)
+	}
+	transport.unicastConns = []udpConnection{conn}
+
+	sender, err := net.DialUDP("udp4", nil, conn.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	response, err := newOneShotResponse(0, &dns.PTR{
+		Hdr: newOneShotHeader("_http._tcp.local.", dns.TypePTR),
+		Ptr: "test._http._tcp.local.",
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep responses arriving until well after the query is done
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+				sender.Write(response)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = queryOnce(ctx, sendlessTransport{transport}, "_http._tcp.local.")
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return countListeners() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newOneShotHeader creates the header of a record sent in response to a one-shot query, whose time-to-live
+// is limited to ten seconds (RFC 6762 Section 6.7).
+func newOneShotHeader(name string, rrType uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    10,
+	}
+}
+
+// newOneShotResponse creates a unicast response to the one-shot query with the given ID.
+func newOneShotResponse(id uint16, answers ...dns.RR) *dns.Msg {
+	response := new(dns.Msg)
+	response.Id = id
+	response.Response = true
+	response.Answer = answers
+
+	return response
+}
+
+// sendlessTransport wraps a UDP transport, dropping sent messages so that tests need not reach the
+// multicast group.
+type sendlessTransport struct {
+	*udpTransport
+}
+
+// Send drops the given message.
+func (t sendlessTransport) Send(msg *dns.Msg, dst *net.UDPAddr) error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package dnssd
+
+import (
+	"log"
+)
+
+const (
+	// Number of queries sent to reconfirm the records of a service instance before they are flushed
+	// (RFC 6762 Section 10.4).
+	reconfirmQueryCount = 3
+)
+
+// onReconfirmRequested handles a request to reconfirm the records of a service instance. The instance's
+// records are queried for a few times and flushed unless they are received again within ten seconds.
+func (r *Resolver) onReconfirmRequested(instanceName serviceInstanceName) {
+	r.onTimeElapsed()
+
+	instanceName = r.cache.getCachedInstanceName(instanceName)
+
+	if !r.cache.reconfirmInstance(instanceName) {
+		log.Printf("dnssd: cannot reconfirm service instance %v which is not in the cache", instanceName)
+		return
+	}
+
+	log.Printf("Reconfirming service instance %v\n", instanceName)
+
+	if _, ok := r.reconfirmations[instanceName]; !ok {
+		r.reconfirmations[instanceName] = &continuousQuery{
+			interval:      initialQueryInterval,
+			nextQueryTime: r.clock.Now(),
+		}
+	}
+
+	r.sendDueQuestions()
+	r.scheduleUpdateTimer()
+}
+
+// getQuestionsForReconfirmations adds the questions of all due reconfirmation queries to the given set,
+// discarding reconfirmations that are complete because all queries were sent or the records were
+// received again.
+func (r *Resolver) getQuestionsForReconfirmations(questions map[question]bool) {
+	now := r.clock.Now()
+
+	for instanceName, query := range r.reconfirmations {
+		if !query.isDue(now) {
+			continue
+		}
+
+		if query.queriesSent >= reconfirmQueryCount || !r.cache.isReconfirming(instanceName) {
+			delete(r.reconfirmations, instanceName)
+			continue
+		}
+
+		r.cache.getQuestionsForReconfirm(instanceName, questions)
+		query.onQuerySent(now)
+	}
+}
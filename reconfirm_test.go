@@ -0,0 +1,36 @@
+package dnssd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconfirmInstanceUnescapedName(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: newLivingRoomResponse(120)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := resolver.ResolveInstance(ctx, `Living\ Room._http._tcp.local.`)
+	assert.NoError(t, err)
+
+	resolver.ReconfirmInstance("living room._HTTP._tcp.local.")
+
+	select {
+	case sent := <-transport.sentCh:
+		assert.Contains(t, sent.msg.Question, dns.Question{
+			Name:   `Living\ Room._http._tcp.local.`,
+			Qtype:  dns.TypeSRV,
+			Qclass: dns.ClassINET,
+		})
+
+	case <-time.After(time.Second):
+		t.Fatal("no reconfirmation query sent")
+	}
+}
@@ -0,0 +1,202 @@
+package dnssd
+
+import (
+	"context"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// recordQuery delivers events for the records answering a single question to the caller of QueryRecord.
+type recordQuery struct {
+	ctx      context.Context
+	doneCh   chan<- *recordQuery // Resolver channel on which the query is handed back once its context is done
+	eventCh  chan RecordEvent    // Events published by the resolver
+	outCh    chan RecordEvent    // Events delivered to the caller
+	query    *continuousQuery
+	question question
+	records  map[genericRecordID]genericRecord // Records the caller has been told about, as last seen
+}
+
+// newRecordQuery creates a new query for the records answering the given question. The query is sent on
+// the given channel once its context is done, so that the resolver stops it.
+func newRecordQuery(ctx context.Context, q question, doneCh chan<- *recordQuery) *recordQuery {
+	return &recordQuery{
+		ctx:      ctx,
+		doneCh:   doneCh,
+		eventCh:  make(chan RecordEvent),
+		outCh:    make(chan RecordEvent),
+		question: q,
+		records:  make(map[genericRecordID]genericRecord),
+	}
+}
+
+// toEventRecord converts the given record into the record delivered in a record event, which does not
+// have the cache flush bit set.
+func toEventRecord(record genericRecord) dns.RR {
+	rr := record.toDNSRecord()
+	rr.Header().Class &^= 1 << cacheFlushBit
+
+	return rr
+}
+
+// checkRecordQueries publishes events describing the changes to the records answering the questions of
+// all record queries. Queries whose context is done are stopped.
+func (r *Resolver) checkRecordQueries() {
+	active := r.recordQueries[:0]
+
+	for _, q := range r.recordQueries {
+		if q.ctx.Err() != nil {
+			q.close()
+			continue
+		}
+
+		r.notifyRecordQuery(q)
+		active = append(active, q)
+	}
+
+	r.recordQueries = active
+}
+
+// getRecordQuestions returns the questions of all record queries.
+func (r *Resolver) getRecordQuestions() []question {
+	questions := make([]question, 0, len(r.recordQueries))
+	for _, q := range r.recordQueries {
+		questions = append(questions, q.question)
+	}
+
+	return questions
+}
+
+// notifyRecordQuery publishes events describing the changes to the records answering the given query's
+// question since the query was last notified. Records received again with a renewed time-to-live are
+// reported as updated.
+func (r *Resolver) notifyRecordQuery(q *recordQuery) {
+	answers := make(map[genericRecordID]genericRecord)
+	for _, answer := range r.cache.getAnswers(q.question) {
+		answers[answer.getID()] = answer
+	}
+
+	for id, old := range q.records {
+		answer, ok := answers[id]
+		if ok && !answer.goodbye {
+			continue
+		}
+
+		reason := RemovalReasonExpired
+		if ok {
+			reason = getRemovalReason([]resourceRecord{answer.resourceRecord})
+		}
+
+		removed := toEventRecord(old)
+		removed.Header().Ttl = 0
+
+		q.eventCh <- RecordEvent{
+			Reason: reason,
+			Record: removed,
+			Type:   RecordEventRemoved,
+		}
+
+		delete(q.records, id)
+	}
+
+	for id, answer := range answers {
+		if answer.goodbye {
+			continue
+		}
+
+		old, ok := q.records[id]
+		if !ok {
+			q.eventCh <- RecordEvent{Record: toEventRecord(answer), Type: RecordEventAdded}
+		} else if answer.renewals != old.renewals {
+			q.eventCh <- RecordEvent{Record: toEventRecord(answer), Type: RecordEventUpdated}
+		}
+
+		q.records[id] = answer
+	}
+}
+
+// onRecordQueryDone handles the context of the given record query being done by stopping the query, so
+// that its question is no longer asked. This has no effect if the query was already stopped.
+func (r *Resolver) onRecordQueryDone(q *recordQuery) {
+	for i, active := range r.recordQueries {
+		if active == q {
+			log.Printf("Stopping query for records %v\n", q.question)
+			q.close()
+			r.recordQueries = append(r.recordQueries[:i], r.recordQueries[i+1:]...)
+			r.scheduleUpdateTimer()
+			return
+		}
+	}
+}
+
+// onRecordQueryRequested handles a request to query for the records answering a question. The caller is
+// immediately notified of all answers that are already cached, and the question is asked continuously
+// after a short random delay.
+func (r *Resolver) onRecordQueryRequested(q *recordQuery) {
+	log.Printf("Querying for records %v\n", q.question)
+
+	go q.forward()
+
+	r.onTimeElapsed()
+	r.notifyRecordQuery(q)
+
+	q.query = newContinuousQuery(r.clock.Now())
+	r.recordQueries = append(r.recordQueries, q)
+	r.scheduleUpdateTimer()
+}
+
+// close stops delivering events to the caller and closes the caller's channel. Any undelivered events
+// are discarded.
+func (q *recordQuery) close() {
+	close(q.eventCh)
+}
+
+// forward delivers events published by the resolver to the caller. Events are queued so that a slow
+// caller never blocks the resolver. Once the query's context is done, the caller's channel is closed, the
+// query is handed back to the resolver, and further events are discarded until the resolver stops the
+// query.
+func (q *recordQuery) forward() {
+	outCh := q.outCh
+	doneCh := q.ctx.Done()
+
+	var resolverDoneCh chan<- *recordQuery
+
+	queue := make([]RecordEvent, 0)
+	for {
+		var nextCh chan RecordEvent
+		var next RecordEvent
+		if len(queue) > 0 {
+			nextCh = outCh
+			next = queue[0]
+		}
+
+		select {
+		case event, ok := <-q.eventCh:
+			if !ok {
+				if outCh != nil {
+					close(outCh)
+				}
+
+				return
+			}
+
+			if outCh != nil {
+				queue = append(queue, event)
+			}
+
+		case nextCh <- next:
+			queue = queue[1:]
+
+		case resolverDoneCh <- q:
+			resolverDoneCh = nil
+
+		case <-doneCh:
+			close(outCh)
+			outCh = nil
+			doneCh = nil
+			queue = nil
+			resolverDoneCh = q.doneCh
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package dnssd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryRecord(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := resolver.QueryRecord(ctx, "printer.local.", dns.TypeHINFO)
+	assert.NoError(t, err)
+
+	sent := <-transport.sentCh
+	assert.Equal(t, []dns.Question{{Name: "printer.local.", Qtype: dns.TypeHINFO, Qclass: dns.ClassINET}}, sent.msg.Question)
+
+	hinfo := &dns.HINFO{
+		Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeHINFO, Class: dns.ClassINET | 1<<cacheFlushBit, Ttl: 120},
+		Cpu: "ARM",
+		Os:  "Linux",
+	}
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = []dns.RR{hinfo}
+	transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: response}
+
+	event := <-events
+	assert.Equal(t, RecordEventAdded, event.Type)
+	assert.Equal(t, uint16(dns.ClassINET), event.Record.Header().Class)
+	assert.Equal(t, uint32(120), event.Record.Header().Ttl)
+	assert.Equal(t, "ARM", event.Record.(*dns.HINFO).Cpu)
+
+	goodbye := new(dns.Msg)
+	goodbye.Response = true
+	goodbye.Answer = []dns.RR{dns.Copy(hinfo)}
+	goodbye.Answer[0].Header().Ttl = 0
+	transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: goodbye}
+
+	event = <-events
+	assert.Equal(t, RecordEventRemoved, event.Type)
+	assert.Equal(t, RemovalReasonGoodbye, event.Reason)
+	assert.Equal(t, uint32(0), event.Record.Header().Ttl)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestQueryRecordRelativeName(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := resolver.QueryRecord(ctx, "printer.local", dns.TypeHINFO)
+	assert.NoError(t, err)
+
+	select {
+	case sent := <-transport.sentCh:
+		assert.Equal(t, []dns.Question{{Name: "printer.local.", Qtype: dns.TypeHINFO, Qclass: dns.ClassINET}}, sent.msg.Question)
+	case <-time.After(time.Second):
+		t.Fatal("no query sent")
+	}
+}
+
+func TestNotifyRecordQueryRenewed(t *testing.T) {
+	resolver := Resolver{cache: newCache()}
+
+	q := newRecordQuery(context.Background(), question{name: "printer.local.", questionType: questionType(dns.TypeHINFO)}, nil)
+	q.eventCh = make(chan RecordEvent, 1)
+
+	hinfo := &dns.HINFO{
+		Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 120},
+		Cpu: "ARM",
+		Os:  "Linux",
+	}
+
+	resolver.cache.onGenericRecordReceived(rrToGenericRecord(hinfo))
+	resolver.notifyRecordQuery(q)
+	assert.Equal(t, RecordEventAdded, (<-q.eventCh).Type)
+
+	// The record is renewed after aging, while the query last saw it when it had just been received
+	resolver.cache.onTimeElapsed(30 * time.Second)
+	resolver.cache.onGenericRecordReceived(rrToGenericRecord(hinfo))
+	resolver.notifyRecordQuery(q)
+
+	event := <-q.eventCh
+	assert.Equal(t, RecordEventUpdated, event.Type)
+	assert.Equal(t, uint32(120), event.Record.Header().Ttl)
+
+	// Receiving the record again without it having aged is not a renewal
+	resolver.cache.onGenericRecordReceived(rrToGenericRecord(hinfo))
+	resolver.notifyRecordQuery(q)
+	assert.Empty(t, q.eventCh)
+}
+
+func TestRecordQueryStoppedWhenDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	doneCh := make(chan *recordQuery)
+
+	q := newRecordQuery(ctx, question{name: "printer.local.", questionType: questionType(dns.TypeHINFO)}, doneCh)
+	go q.forward()
+
+	resolver := Resolver{
+		clock:         SystemClock(),
+		recordQueries: []*recordQuery{q},
+		updateTimer:   timerCreate(SystemClock()),
+	}
+
+	// The query is handed back to the resolver as soon as its context is done, without waiting for the
+	// resolver's next update
+	cancel()
+
+	select {
+	case done := <-doneCh:
+		resolver.onRecordQueryDone(done)
+	case <-time.After(time.Second):
+		t.Fatal("record query was not handed back")
+	}
+
+	assert.Empty(t, resolver.recordQueries)
+
+	_, ok := <-q.outCh
+	assert.False(t, ok)
+}
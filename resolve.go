@@ -0,0 +1,93 @@
+package dnssd
+
+import (
+	"context"
+	"log"
+)
+
+// resolveRequest contains all data to request resolving a single service instance.
+type resolveRequest struct {
+	askedQuestions map[question]bool
+	ctx            context.Context
+	instanceName   serviceInstanceName
+	query          *continuousQuery // Schedules asking again for records that are still missing
+	responseCh     chan []ServiceInstance
+}
+
+// checkPendingResolves completes all pending requests to resolve service instances that can now be
+// resolved from the cache, asking any new questions needed to resolve the rest. Requests whose context
+// is done are discarded.
+func (r *Resolver) checkPendingResolves() {
+	pending := r.pendingResolves[:0]
+
+	for _, request := range r.pendingResolves {
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		if r.tryResolve(request) {
+			continue
+		}
+
+		r.sendQuestionsForResolve(request)
+		pending = append(pending, request)
+	}
+
+	r.pendingResolves = pending
+}
+
+// onResolveRequested handles a request to resolve a single service instance.
+func (r *Resolver) onResolveRequested(request resolveRequest) {
+	if r.tryResolve(request) {
+		return
+	}
+
+	log.Printf("Resolving service instance %v\n", request.instanceName)
+	r.sendQuestionsForResolve(request)
+
+	request.query.onQuerySent(r.clock.Now())
+	r.pendingResolves = append(r.pendingResolves, request)
+	r.scheduleUpdateTimer()
+}
+
+// sendQuestionsForResolve sends the questions for all records that are still needed to complete the
+// given request and have not yet been asked for it. Unanswered questions are asked again each time the
+// request's continuous query is due.
+func (r *Resolver) sendQuestionsForResolve(request resolveRequest) {
+	questionSet := make(map[question]bool)
+	addressRecords := addressRecordsByHostName(r.cache.addressRecords)
+	instanceName := r.cache.getCachedInstanceName(request.instanceName)
+	r.cache.getQuestionsForMissingInstanceRecords(instanceName, addressRecords, questionSet)
+
+	questions := make([]question, 0, len(questionSet))
+	for q := range questionSet {
+		if !request.askedQuestions[q] {
+			request.askedQuestions[q] = true
+			questions = append(questions, q)
+		}
+	}
+
+	if len(questions) == 0 {
+		return
+	}
+
+	err := r.netClient.sendQuestions(questions, r.cache.getKnownAnswers(questions))
+	if err != nil {
+		log.Printf("dnssd: failed sending questions to resolve %v: %v", request.instanceName, err)
+	}
+}
+
+// tryResolve completes the given request if the requested service instance can be resolved from the
+// cache. Returns true if the request was completed.
+func (r *Resolver) tryResolve(request resolveRequest) bool {
+	addressRecords := addressRecordsByHostName(r.cache.addressRecords)
+
+	instanceName := r.cache.getCachedInstanceName(request.instanceName)
+	instances := r.cache.resolveInstance(instanceName, addressRecords)
+	if len(instances) == 0 {
+		return false
+	}
+
+	request.responseCh <- instances
+	return true
+}
@@ -0,0 +1,25 @@
+package dnssd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveInstanceUnescapedName(t *testing.T) {
+	resolver, transport := newTestResolver(t)
+
+	transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: newLivingRoomResponse(120)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The instance is cached under its escaped name, but may be resolved by its user-friendly name in any case
+	instances, err := resolver.ResolveInstance(ctx, "living room._HTTP._tcp.local.")
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, `Living\ Room._http._tcp.local.`, instances[0].InstanceName)
+	assert.Equal(t, uint16(8080), instances[0].Port)
+}
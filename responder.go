@@ -0,0 +1,1094 @@
+package dnssd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Recommended time-to-live values for records containing a host name and for all other records,
+	// respectively, as per RFC 6762 section 10.
+	hostRecordTimeToLive  = 120 * time.Second
+	otherRecordTimeToLive = 75 * time.Minute
+
+	// Maximum time-to-live of records sent in response to legacy unicast queries, as per RFC 6762
+	// section 6.7.
+	legacyUnicastTimeToLive = 10 * time.Second
+
+	// Probing parameters from RFC 6762 section 8.1.
+	maxInitialProbeDelay   = 250 * time.Millisecond
+	probeCount             = 3
+	probeInterval          = 250 * time.Millisecond
+	probeDeferralDelay     = time.Second
+	probeRateLimitConflict = 15
+	probeRateLimitDelay    = 5 * time.Second
+	probeRateLimitWindow   = 10 * time.Second
+
+	// Announcement parameters from RFC 6762 section 8.3.
+	announcementCount    = 2
+	announcementInterval = time.Second
+
+	// Responses containing shared records are delayed by a random amount within this range, as per RFC
+	// 6762 section 6.
+	maxResponseDelay = 120 * time.Millisecond
+	minResponseDelay = 20 * time.Millisecond
+
+	// Responses to queries whose known answers continue in subsequent packets are delayed by a random
+	// amount within this range, as per RFC 6762 section 7.2.
+	maxTruncatedResponseDelay = 500 * time.Millisecond
+	minTruncatedResponseDelay = 400 * time.Millisecond
+)
+
+var (
+	// hostSuffixRegexp matches the numeric suffix appended to the first label of a host name when
+	// renaming it after a name conflict.
+	hostSuffixRegexp = regexp.MustCompile(`^(.*)-(\d+)$`)
+
+	// nameSuffixRegexp matches the numeric suffix appended to an instance name when renaming it after a
+	// name conflict.
+	nameSuffixRegexp = regexp.MustCompile(`^(.*) \((\d+)\)$`)
+)
+
+// delayedResponse contains the answers to queries for shared records that are waiting to be multicast.
+// Answers sent by other responders in the meantime are removed from it (RFC 6762 Section 7.4).
+type delayedResponse struct {
+	answers []dns.RR
+	extras  []dns.RR
+}
+
+// truncatedQuery is a query whose known answers continue in subsequent packets from the same host. It is
+// answered once those packets have had time to arrive (RFC 6762 Section 7.2).
+type truncatedQuery struct {
+	query        query
+	responseTime time.Time
+}
+
+type registrationState int
+
+const (
+	registrationStateProbing registrationState = iota
+	registrationStateAnnouncing
+	registrationStateRegistered
+)
+
+// registration contains the resource records advertised for a single registered service instance.
+type registration struct {
+	addressRecords    []addressRecord
+	announcementsSent int
+	conflictTimes     []time.Time // Times of recent name conflicts, used for rate limiting probes
+	name              string
+	nextTransmitTime  time.Time
+	onNameConflict    func(oldName, newName string)
+	pointerRecord     pointerRecord
+	probesSent        int
+	responseCh        chan registerResponse // Receives the final instance name once probing completes
+	serviceRecord     serviceRecord
+	state             registrationState
+	textRecord        textRecord
+}
+
+// registerRequest contains all data to request registering a new service instance.
+type registerRequest struct {
+	registration ServiceRegistration
+	responseCh   chan registerResponse
+}
+
+// registerResponse contains the result of a request to register a new service instance.
+type registerResponse struct {
+	err          error
+	instanceName serviceInstanceName
+}
+
+// defaultHostName returns the host name to advertise services on when one is not provided.
+func defaultHostName() (hostName, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("dnssd: failed getting host name: %v", err)
+	}
+
+	// Only use the first label of the system host name as mDNS host names are always in the
+	// local domain.
+	name = strings.SplitN(name, ".", 2)[0]
+
+	return hostName(labelEscape(name) + ".local."), nil
+}
+
+// newRegistration creates the set of resource records to advertise for the given service. If the service
+// does not specify any addresses, then the provided local addresses are used.
+func newRegistration(service ServiceRegistration, localAddresses []net.IP) (reg registration, err error) {
+	const (
+		maxLabelLength = 63 // RFC 1035 Section 2.3.4
+	)
+
+	if service.Name == "" || len(service.Name) > maxLabelLength {
+		err = fmt.Errorf("dnssd: invalid service instance name %q", service.Name)
+		return
+	}
+
+	if service.ServiceName == "" {
+		err = fmt.Errorf("dnssd: service name must be provided")
+		return
+	}
+
+	if service.TextRecords != nil && service.TextRecordsRaw != nil {
+		err = fmt.Errorf("dnssd: only one of TextRecords and TextRecordsRaw may be provided")
+		return
+	}
+
+	if service.TextRecordsRaw != nil {
+		err = validateTXTStrings(service.TextRecordsRaw)
+	} else {
+		err = validateTXT(service.TextRecords)
+	}
+	if err != nil {
+		return
+	}
+
+	target := hostName(dns.Fqdn(service.HostName))
+	if service.HostName == "" {
+		target, err = defaultHostName()
+		if err != nil {
+			return
+		}
+	}
+
+	addresses := service.Addresses
+	if len(addresses) == 0 {
+		addresses = localAddresses
+	}
+
+	if len(addresses) == 0 {
+		err = fmt.Errorf("dnssd: no addresses available for host %v", target)
+		return
+	}
+
+	name := serviceName(dns.Fqdn(service.ServiceName))
+	instanceName := serviceInstanceName(labelEscape(service.Name) + "." + name.String())
+
+	for _, address := range addresses {
+		reg.addressRecords = append(reg.addressRecords, addressRecord{
+			address:        address,
+			name:           target,
+			resourceRecord: newUniqueResourceRecord(hostRecordTimeToLive),
+		})
+	}
+
+	reg.pointerRecord = pointerRecord{
+		instanceName:   instanceName,
+		serviceName:    name,
+		resourceRecord: newSharedResourceRecord(otherRecordTimeToLive),
+	}
+
+	reg.serviceRecord = serviceRecord{
+		instanceName:   instanceName,
+		port:           service.Port,
+		serviceName:    name,
+		target:         target,
+		resourceRecord: newUniqueResourceRecord(hostRecordTimeToLive),
+	}
+
+	reg.textRecord = textRecord{
+		instanceName:   instanceName,
+		serviceName:    name,
+		values:         service.TextRecords,
+		resourceRecord: newUniqueResourceRecord(otherRecordTimeToLive),
+	}
+
+	if service.TextRecordsRaw != nil {
+		reg.textRecord.raw = service.TextRecordsRaw
+		reg.textRecord.values = txtToMap(service.TextRecordsRaw)
+	}
+
+	reg.name = service.Name
+	reg.onNameConflict = service.OnNameConflict
+	reg.state = registrationStateProbing
+
+	return
+}
+
+// nextHostName returns the host name to try after the given host name conflicted with another host's,
+// e.g. "printer.local." becomes "printer-2.local." and "printer-2.local." becomes "printer-3.local."
+// (RFC 6762 Section 9).
+func nextHostName(name hostName) hostName {
+	labels := strings.SplitN(name.String(), ".", 2)
+	if matches := hostSuffixRegexp.FindStringSubmatch(labels[0]); matches != nil {
+		if n, err := strconv.Atoi(matches[2]); err == nil {
+			labels[0] = fmt.Sprintf("%v-%v", matches[1], n+1)
+			return hostName(strings.Join(labels, "."))
+		}
+	}
+
+	labels[0] += "-2"
+	return hostName(strings.Join(labels, "."))
+}
+
+// nextInstanceName returns the name to try after the given instance name conflicted with another
+// host's, e.g. "Printer" becomes "Printer (2)" and "Printer (2)" becomes "Printer (3)"
+// (RFC 6762 Section 9).
+func nextInstanceName(name string) string {
+	if matches := nameSuffixRegexp.FindStringSubmatch(name); matches != nil {
+		if n, err := strconv.Atoi(matches[2]); err == nil {
+			return fmt.Sprintf("%v (%v)", matches[1], n+1)
+		}
+	}
+
+	return name + " (2)"
+}
+
+// newSharedResourceRecord creates a resource record for a record that may be advertised by
+// multiple hosts.
+func newSharedResourceRecord(timeToLive time.Duration) resourceRecord {
+	return resourceRecord{
+		initialTimeToLive:   timeToLive,
+		remainingTimeToLive: timeToLive,
+	}
+}
+
+// newUniqueResourceRecord creates a resource record for a record that only this host advertises.
+func newUniqueResourceRecord(timeToLive time.Duration) resourceRecord {
+	return resourceRecord{
+		cacheFlush:          true,
+		initialTimeToLive:   timeToLive,
+		remainingTimeToLive: timeToLive,
+	}
+}
+
+// recordInKnownAnswers returns true if the given record is contained in the known answers and the
+// known answer's time-to-live is at least half of the record's time-to-live, in which case the
+// record need not be sent (RFC 6762 Section 7.1).
+func recordInKnownAnswers(record dns.RR, knownAnswers []dns.RR) bool {
+	for _, knownAnswer := range knownAnswers {
+		if recordsEqual(record, knownAnswer) && knownAnswer.Header().Ttl >= record.Header().Ttl/2 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordsEqual returns true if the given records have the same name, type, class, and data, ignoring
+// their time-to-live values and cache flush bits.
+func recordsEqual(a, b dns.RR) bool {
+	a = dns.Copy(a)
+	b = dns.Copy(b)
+
+	a.Header().Class &^= 1 << cacheFlushBit
+	b.Header().Class &^= 1 << cacheFlushBit
+
+	return dns.IsDuplicate(a, b)
+}
+
+// recordCompare lexicographically compares the given records by class, type, and raw record data as
+// described in RFC 6762 Section 8.2. Returns a negative value if a is less than b, a positive value if a
+// is greater than b, and zero if they are equal.
+func recordCompare(a, b dns.RR) int {
+	aClass := a.Header().Class &^ (1 << cacheFlushBit)
+	bClass := b.Header().Class &^ (1 << cacheFlushBit)
+	if aClass != bClass {
+		return int(aClass) - int(bClass)
+	}
+
+	if a.Header().Rrtype != b.Header().Rrtype {
+		return int(a.Header().Rrtype) - int(b.Header().Rrtype)
+	}
+
+	return bytes.Compare(recordRawData(a), recordRawData(b))
+}
+
+// recordRawData returns the raw, uncompressed record data of the given record.
+func recordRawData(rr dns.RR) []byte {
+	buf := make([]byte, dns.MaxMsgSize)
+
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	nameEnd, err := dns.PackDomainName(rr.Header().Name, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	// The record data follows the name, type, class, time-to-live, and data length fields
+	const fixedHeaderLength = 10
+	return buf[nameEnd+fixedHeaderLength : end]
+}
+
+// recordSetCompare lexicographically compares the given sets of records as described in RFC 6762
+// Section 8.2. Returns a negative value if a is less than b, a positive value if a is greater than b,
+// and zero if they are equal.
+func recordSetCompare(a, b []dns.RR) int {
+	sortRecords := func(records []dns.RR) []dns.RR {
+		sorted := append([]dns.RR(nil), records...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return recordCompare(sorted[i], sorted[j]) < 0
+		})
+
+		return sorted
+	}
+
+	a = sortRecords(a)
+	b = sortRecords(b)
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if result := recordCompare(a[i], b[i]); result != 0 {
+			return result
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// recordsWithName returns the given records that have the given name.
+func recordsWithName(records []dns.RR, name string) []dns.RR {
+	var named []dns.RR
+	for _, rr := range records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			named = append(named, rr)
+		}
+	}
+
+	return named
+}
+
+// recordsAppendUnique appends all records to the given list which are not already contained in it.
+func recordsAppendUnique(records []dns.RR, newRecords ...dns.RR) []dns.RR {
+	for _, newRecord := range newRecords {
+		if !recordsContain(records, newRecord) {
+			records = append(records, newRecord)
+		}
+	}
+
+	return records
+}
+
+// newResponse creates a response message containing the given answers and the extras that are not
+// already among the answers.
+func newResponse(answers, extras []dns.RR) *dns.Msg {
+	response := dns.Msg{}
+	response.Response = true
+	response.Authoritative = true
+	response.Answer = answers
+
+	for _, extra := range extras {
+		if !recordsContain(answers, extra) {
+			response.Extra = append(response.Extra, extra)
+		}
+	}
+
+	return &response
+}
+
+// recordsAllUnique returns true if all of the given records are unique records, which are sent with the
+// cache flush bit set (RFC 6762 Section 10.2).
+func recordsAllUnique(records []dns.RR) bool {
+	for _, record := range records {
+		if record.Header().Class&(1<<cacheFlushBit) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordsContain returns true if the given record is contained in the list of records.
+func recordsContain(records []dns.RR, record dns.RR) bool {
+	for _, r := range records {
+		if recordsEqual(r, record) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkForNameConflicts checks whether any of the received answers conflict with the records of any of
+// the registered service instances. The host's address records are only checked against answers from
+// other hosts, as other responders on this host may publish the same host name.
+func (r *Resolver) checkForNameConflicts(answers answerSet) {
+	fromOtherHost := !r.isOwnSource(answers.source)
+
+	for _, reg := range r.registrations {
+		hostConflict := fromOtherHost && reg.hostConflictsWith(answers, r.getHostAddresses(reg.serviceRecord.target))
+		if hostConflict || reg.conflictsWith(answers) {
+			r.onNameConflict(reg, hostConflict)
+		}
+	}
+}
+
+// checkForSimultaneousProbes checks whether the given query is a probe from another host for the same
+// name as one of the service instances currently being probed for. If so, the conflict is resolved
+// as described in RFC 6762 Section 8.2.
+func (r *Resolver) checkForSimultaneousProbes(query query) {
+	if len(query.authorities) == 0 {
+		return
+	}
+
+	for _, reg := range r.registrations {
+		if reg.state != registrationStateProbing {
+			continue
+		}
+
+		lost := false
+		for _, name := range []string{reg.serviceRecord.instanceName.String(), reg.serviceRecord.target.String()} {
+			theirRecords := recordsWithName(query.authorities, name)
+			if len(theirRecords) > 0 && recordSetCompare(recordsWithName(reg.getProbeRecords(), name), theirRecords) < 0 {
+				lost = true
+			}
+		}
+
+		if !lost {
+			continue
+		}
+
+		// We lost the tie-break. Defer to the other host by waiting one second, then probe again. If the
+		// other host has in fact claimed the name, we will find a conflict during the next probe.
+		log.Printf("Lost simultaneous probe tie-break for %v\n", reg.serviceRecord.instanceName)
+		reg.probesSent = 0
+		reg.nextTransmitTime = r.clock.Now().Add(probeDeferralDelay)
+	}
+
+	r.scheduleRegistrationTimer()
+}
+
+// onNameConflict handles another host on the network claiming the name of the given service instance, or
+// of its host if hostConflict is set. A registration that has already claimed its names probes for them
+// again, as the conflict may have been transient, while a registration that is probing chooses a new name
+// and probes for it (RFC 6762 Section 9).
+func (r *Resolver) onNameConflict(reg *registration, hostConflict bool) {
+	now := r.clock.Now()
+	oldInstanceName := reg.serviceRecord.instanceName
+	oldName := reg.name
+
+	switch {
+	case reg.state != registrationStateProbing:
+		log.Printf("Name conflict for %v, probing again\n", oldInstanceName)
+
+	case hostConflict:
+		oldHostName := reg.serviceRecord.target
+		reg.renameHost(nextHostName(oldHostName))
+
+		log.Printf("Host name conflict for %v, renaming to %v\n", oldHostName, reg.serviceRecord.target)
+
+	default:
+		delete(r.registrations, oldInstanceName)
+		reg.rename(nextInstanceName(reg.name))
+		r.registrations[reg.serviceRecord.instanceName] = reg
+
+		log.Printf("Name conflict for %v, renaming to %v\n", oldInstanceName, reg.serviceRecord.instanceName)
+
+		if reg.onNameConflict != nil {
+			go reg.onNameConflict(oldName, reg.name)
+		}
+	}
+
+	// Limit the rate at which we probe if we are repeatedly finding conflicts (RFC 6762 Section 8.1)
+	recentConflicts := make([]time.Time, 0, len(reg.conflictTimes)+1)
+	for _, conflictTime := range reg.conflictTimes {
+		if now.Sub(conflictTime) < probeRateLimitWindow {
+			recentConflicts = append(recentConflicts, conflictTime)
+		}
+	}
+	reg.conflictTimes = append(recentConflicts, now)
+
+	delay := time.Duration(rand.Int63n(int64(maxInitialProbeDelay)))
+	if len(reg.conflictTimes) >= probeRateLimitConflict {
+		delay = probeRateLimitDelay
+	}
+
+	reg.state = registrationStateProbing
+	reg.probesSent = 0
+	reg.nextTransmitTime = now.Add(delay)
+
+	r.scheduleRegistrationTimer()
+}
+
+// onQueryReceived handles receiving a query from another host, answering any questions about
+// registered service instances. Queries with more known answers to follow are answered once the rest of
+// the known answers have had time to arrive.
+func (r *Resolver) onQueryReceived(query query) {
+	r.checkForSimultaneousProbes(query)
+
+	if pending := r.getTruncatedQuery(query.source); pending != nil {
+		// The packet continues the known answers of a truncated query from the same host
+		pending.query.questions = append(pending.query.questions, query.questions...)
+		pending.query.knownAnswers = append(pending.query.knownAnswers, query.knownAnswers...)
+		return
+	}
+
+	if query.truncated && query.source != nil {
+		delay := minTruncatedResponseDelay + time.Duration(rand.Int63n(int64(maxTruncatedResponseDelay-minTruncatedResponseDelay)))
+		r.truncatedQueries = append(r.truncatedQueries, &truncatedQuery{
+			query:        query,
+			responseTime: r.clock.Now().Add(delay),
+		})
+		r.scheduleTruncatedQueryTimer()
+		return
+	}
+
+	r.answerQuery(query)
+}
+
+// answerQuery answers any questions of the given query about registered service instances.
+func (r *Resolver) answerQuery(query query) {
+	var answers, extras []dns.RR
+
+	for _, q := range query.questions {
+		for _, reg := range r.registrations {
+			if reg.state == registrationStateProbing {
+				// We must not answer for records we have not yet claimed
+				continue
+			}
+
+			questionAnswers, questionExtras := reg.getAnswers(q)
+
+			for _, answer := range questionAnswers {
+				if !recordInKnownAnswers(answer, query.knownAnswers) {
+					answers = recordsAppendUnique(answers, answer)
+					extras = recordsAppendUnique(extras, questionExtras...)
+				}
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return
+	}
+
+	// Truncated queries have already been delayed while waiting for their known answers
+	unicast := query.isLegacyUnicast() || query.isUnicastResponse()
+	if !unicast && !query.truncated && !recordsAllUnique(answers) {
+		r.delayResponse(answers, extras)
+		return
+	}
+
+	response := newResponse(answers, extras)
+
+	var err error
+	if query.isLegacyUnicast() {
+		err = r.netClient.sendResponseTo(query.toLegacyUnicastResponse(response), query.source)
+	} else if query.isUnicastResponse() {
+		err = r.netClient.sendResponseTo(response, query.source)
+	} else {
+		err = r.netClient.sendResponse(response)
+	}
+
+	if err != nil {
+		log.Printf("dnssd: failed sending response: %v", err)
+	}
+}
+
+// delayResponse adds the given answers to the delayed response, scheduling it to be sent after a random
+// delay if it is not already pending. Responses containing shared records are delayed to avoid
+// collisions with other responders answering the same query (RFC 6762 Section 6).
+func (r *Resolver) delayResponse(answers, extras []dns.RR) {
+	if r.delayedResponse == nil {
+		r.delayedResponse = &delayedResponse{}
+
+		delay := minResponseDelay + time.Duration(rand.Int63n(int64(maxResponseDelay-minResponseDelay)))
+		timerReset(r.responseTimer, delay)
+	}
+
+	r.delayedResponse.answers = recordsAppendUnique(r.delayedResponse.answers, answers...)
+	r.delayedResponse.extras = recordsAppendUnique(r.delayedResponse.extras, extras...)
+}
+
+// onResponseTimer handles sending the delayed response once its delay has elapsed.
+func (r *Resolver) onResponseTimer() {
+	delayed := r.delayedResponse
+	r.delayedResponse = nil
+
+	if delayed == nil || len(delayed.answers) == 0 {
+		// All answers were sent by other responders in the meantime
+		return
+	}
+
+	err := r.netClient.sendResponse(newResponse(delayed.answers, delayed.extras))
+	if err != nil {
+		log.Printf("dnssd: failed sending response: %v", err)
+	}
+}
+
+// suppressDuplicateAnswers removes the answers sent by another responder from the delayed response. An
+// answer is only removed if the other responder sent it with at least half of our time-to-live (RFC 6762
+// Section 7.4).
+func (r *Resolver) suppressDuplicateAnswers(answers answerSet) {
+	if r.delayedResponse == nil {
+		return
+	}
+
+	received := answers.toDNSRecords()
+
+	remaining := r.delayedResponse.answers[:0]
+	for _, answer := range r.delayedResponse.answers {
+		if !recordInKnownAnswers(answer, received) {
+			remaining = append(remaining, answer)
+		}
+	}
+
+	r.delayedResponse.answers = remaining
+}
+
+// onTruncatedQueryTimer handles the truncated query timer firing by answering all truncated queries whose
+// remaining known answers have had time to arrive.
+func (r *Resolver) onTruncatedQueryTimer() {
+	now := r.clock.Now()
+
+	pending := r.truncatedQueries[:0]
+	for _, truncated := range r.truncatedQueries {
+		if truncated.responseTime.After(now) {
+			pending = append(pending, truncated)
+			continue
+		}
+
+		r.answerQuery(truncated.query)
+	}
+	r.truncatedQueries = pending
+
+	r.scheduleTruncatedQueryTimer()
+}
+
+// onRegistrationTimer handles sending probes and announcements for all service instances whose next
+// probe or announcement is due.
+func (r *Resolver) onRegistrationTimer() {
+	now := r.clock.Now()
+
+	for _, reg := range r.registrations {
+		if !reg.isTransmitPending() || reg.nextTransmitTime.After(now) {
+			continue
+		}
+
+		if reg.state == registrationStateAnnouncing {
+			r.sendAnnouncement(reg)
+			continue
+		}
+
+		if reg.probesSent == probeCount {
+			r.onProbingComplete(reg)
+			continue
+		}
+
+		log.Printf("Sending probe for %v\n", reg.serviceRecord.instanceName)
+		err := r.netClient.sendProbe(reg.getProbeQuestions(), reg.getProbeRecords())
+		if err != nil {
+			log.Printf("dnssd: failed sending probe: %v", err)
+		}
+
+		reg.probesSent++
+		reg.nextTransmitTime = now.Add(probeInterval)
+	}
+
+	r.scheduleRegistrationTimer()
+}
+
+// onProbingComplete handles successfully claiming the name of the given service instance.
+func (r *Resolver) onProbingComplete(reg *registration) {
+	log.Printf("Registered service instance %v\n", reg.serviceRecord.instanceName)
+	reg.state = registrationStateAnnouncing
+	reg.announcementsSent = 0
+	r.sendAnnouncement(reg)
+
+	if reg.responseCh != nil {
+		reg.responseCh <- registerResponse{instanceName: reg.serviceRecord.instanceName}
+		reg.responseCh = nil
+	}
+}
+
+// onServiceRegistered handles a request to register a new service instance.
+func (r *Resolver) onServiceRegistered(request registerRequest) {
+	reg, err := newRegistration(request.registration, r.localAddresses)
+	if err != nil {
+		request.responseCh <- registerResponse{err: err}
+		return
+	}
+
+	instanceName := reg.serviceRecord.instanceName
+	if _, ok := r.registrations[instanceName]; ok {
+		request.responseCh <- registerResponse{err: fmt.Errorf("dnssd: service instance %v is already registered", instanceName)}
+		return
+	}
+
+	log.Printf("Probing for service instance %v\n", instanceName)
+
+	// Delay the first probe by a random amount to avoid colliding with other hosts powering on at the
+	// same time (RFC 6762 Section 8.1)
+	reg.nextTransmitTime = r.clock.Now().Add(time.Duration(rand.Int63n(int64(maxInitialProbeDelay))))
+	reg.responseCh = request.responseCh
+	r.registrations[instanceName] = &reg
+
+	r.scheduleRegistrationTimer()
+}
+
+// onServiceUnregistered handles a request to stop advertising the given service instance.
+func (r *Resolver) onServiceUnregistered(instanceName serviceInstanceName) {
+	for registeredName := range r.registrations {
+		if strings.EqualFold(registeredName.String(), instanceName.String()) {
+			instanceName = registeredName
+			break
+		}
+	}
+
+	reg, ok := r.registrations[instanceName]
+	if !ok {
+		return
+	}
+
+	log.Printf("Unregistering service instance %v\n", instanceName)
+	reg.cancel()
+	r.sendGoodbye(reg)
+	delete(r.registrations, instanceName)
+}
+
+// scheduleRegistrationTimer schedules the registration timer to fire when the next probe or
+// announcement is due.
+func (r *Resolver) scheduleRegistrationTimer() {
+	var nextTransmitTime time.Time
+	for _, reg := range r.registrations {
+		if reg.isTransmitPending() && (nextTransmitTime.IsZero() || reg.nextTransmitTime.Before(nextTransmitTime)) {
+			nextTransmitTime = reg.nextTransmitTime
+		}
+	}
+
+	if nextTransmitTime.IsZero() {
+		timerStop(r.registrationTimer)
+		return
+	}
+
+	timerReset(r.registrationTimer, nextTransmitTime.Sub(r.clock.Now()))
+}
+
+// scheduleTruncatedQueryTimer schedules the truncated query timer to fire when the next truncated query is
+// due to be answered.
+func (r *Resolver) scheduleTruncatedQueryTimer() {
+	var responseTime time.Time
+	for _, truncated := range r.truncatedQueries {
+		if responseTime.IsZero() || truncated.responseTime.Before(responseTime) {
+			responseTime = truncated.responseTime
+		}
+	}
+
+	if responseTime.IsZero() {
+		timerStop(r.truncatedQueryTimer)
+		return
+	}
+
+	timerReset(r.truncatedQueryTimer, responseTime.Sub(r.clock.Now()))
+}
+
+// sendAnnouncement sends an unsolicited response containing all of the given service instance's
+// records (RFC 6762 Section 8.3).
+func (r *Resolver) sendAnnouncement(reg *registration) {
+	log.Printf("Sending announcement for %v\n", reg.serviceRecord.instanceName)
+
+	response := dns.Msg{}
+	response.Response = true
+	response.Authoritative = true
+	response.Answer = reg.getAllRecords()
+
+	err := r.netClient.sendResponse(&response)
+	if err != nil {
+		log.Printf("dnssd: failed sending announcement: %v", err)
+	}
+
+	reg.announcementsSent++
+	if reg.announcementsSent == announcementCount {
+		reg.state = registrationStateRegistered
+		return
+	}
+
+	// Each announcement is sent at twice the interval of the previous one
+	reg.nextTransmitTime = r.clock.Now().Add(announcementInterval << uint(reg.announcementsSent-1))
+}
+
+// sendGoodbye sends a response containing all of the given service instance's records with a
+// time-to-live of zero, informing other hosts that the instance is no longer available (RFC 6762
+// Section 10.1). The host's address records are only included if no other registration uses the same
+// host. Nothing is sent for instances that have not yet claimed their name.
+func (r *Resolver) sendGoodbye(reg *registration) {
+	if reg.state == registrationStateProbing {
+		return
+	}
+
+	log.Printf("Sending goodbye for %v\n", reg.serviceRecord.instanceName)
+
+	response := dns.Msg{}
+	response.Response = true
+	response.Authoritative = true
+
+	records := []dns.RR{
+		reg.pointerRecord.toDNSRecord(),
+		reg.serviceRecord.toDNSRecord(),
+		reg.textRecord.toDNSRecord(),
+	}
+
+	if !r.isHostShared(reg) {
+		records = append(records, reg.getAddressRecords(questionTypeAny)...)
+	}
+
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+		response.Answer = append(response.Answer, rr)
+	}
+
+	err := r.netClient.sendResponse(&response)
+	if err != nil {
+		log.Printf("dnssd: failed sending goodbye: %v", err)
+	}
+}
+
+// getTruncatedQuery returns the truncated query from the given source that is waiting for the rest of its
+// known answers, or nil if there is none.
+func (r *Resolver) getTruncatedQuery(source *net.UDPAddr) *truncatedQuery {
+	if source == nil {
+		return nil
+	}
+
+	for _, truncated := range r.truncatedQueries {
+		if truncated.query.source.IP.Equal(source.IP) && truncated.query.source.Port == source.Port {
+			return truncated
+		}
+	}
+
+	return nil
+}
+
+// getHostAddresses returns the addresses that any of the registrations publish for the given host.
+func (r *Resolver) getHostAddresses(host hostName) []net.IP {
+	var addresses []net.IP
+	for _, reg := range r.registrations {
+		if strings.EqualFold(reg.serviceRecord.target.String(), host.String()) {
+			for _, address := range reg.addressRecords {
+				addresses = append(addresses, address.address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// isHostShared returns true if any registration other than the given one has claimed its name on the
+// same host, and so still needs the host's address records.
+func (r *Resolver) isHostShared(reg *registration) bool {
+	for _, other := range r.registrations {
+		if other == reg || other.state == registrationStateProbing {
+			continue
+		}
+
+		if strings.EqualFold(other.serviceRecord.target.String(), reg.serviceRecord.target.String()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cancel fails any outstanding request to register the service instance.
+func (reg *registration) cancel() {
+	if reg.responseCh != nil {
+		reg.responseCh <- registerResponse{err: fmt.Errorf("dnssd: registration of %v cancelled", reg.serviceRecord.instanceName)}
+		reg.responseCh = nil
+	}
+}
+
+// conflictsWith returns true if any of the given answers contain a record with the same name as one of
+// the registration's unique records but with different data.
+func (reg *registration) conflictsWith(answers answerSet) bool {
+	ourService := reg.serviceRecord.toDNSRecord()
+	for _, service := range answers.serviceRecords {
+		if strings.EqualFold(service.instanceName.String(), reg.serviceRecord.instanceName.String()) &&
+			!recordsEqual(ourService, service.toDNSRecord()) {
+			return true
+		}
+	}
+
+	ourText := reg.textRecord.toDNSRecord()
+	for _, text := range answers.textRecords {
+		if strings.EqualFold(text.instanceName.String(), reg.textRecord.instanceName.String()) &&
+			!recordsEqual(ourText, text.toDNSRecord()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostConflictsWith returns true if any of the given answers contain an address record for the
+// registration's host with an address that is not among the given addresses published for the host.
+func (reg *registration) hostConflictsWith(answers answerSet, addresses []net.IP) bool {
+	for _, answer := range answers.addressRecords {
+		if answer.isGoodbye() || !strings.EqualFold(answer.name.String(), reg.serviceRecord.target.String()) {
+			continue
+		}
+
+		found := false
+		for _, address := range addresses {
+			if address.Equal(answer.address) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getAnswers returns the registration's records that answer the given question along with any
+// additional records that should accompany those answers (RFC 6763 Section 12).
+func (reg *registration) getAnswers(q question) (answers []dns.RR, extras []dns.RR) {
+	isAny := q.questionType == questionTypeAny
+
+	if (isAny || q.questionType == questionTypePointer) && strings.EqualFold(q.name, reg.pointerRecord.serviceName.String()) {
+		answers = append(answers, reg.pointerRecord.toDNSRecord())
+		extras = append(extras, reg.serviceRecord.toDNSRecord(), reg.textRecord.toDNSRecord())
+		extras = append(extras, reg.getAddressRecords(questionTypeAny)...)
+	}
+
+	if strings.EqualFold(q.name, reg.serviceRecord.instanceName.String()) {
+		if isAny || q.questionType == questionTypeService {
+			answers = append(answers, reg.serviceRecord.toDNSRecord())
+			extras = append(extras, reg.getAddressRecords(questionTypeAny)...)
+		}
+
+		if isAny || q.questionType == questionTypeText {
+			answers = append(answers, reg.textRecord.toDNSRecord())
+		}
+	}
+
+	if strings.EqualFold(q.name, reg.serviceRecord.target.String()) {
+		answers = append(answers, reg.getAddressRecords(q.questionType)...)
+	}
+
+	return
+}
+
+// getAddressRecords returns the registration's address records matching the given question type.
+func (reg *registration) getAddressRecords(qType questionType) []dns.RR {
+	records := make([]dns.RR, 0, len(reg.addressRecords))
+
+	for _, address := range reg.addressRecords {
+		if qType == questionTypeAny || address.getQuestion().questionType == qType {
+			records = append(records, address.toDNSRecord())
+		}
+	}
+
+	return records
+}
+
+// getAllRecords returns all of the records advertised for the registered service instance.
+func (reg *registration) getAllRecords() []dns.RR {
+	records := []dns.RR{
+		reg.pointerRecord.toDNSRecord(),
+		reg.serviceRecord.toDNSRecord(),
+		reg.textRecord.toDNSRecord(),
+	}
+
+	return append(records, reg.getAddressRecords(questionTypeAny)...)
+}
+
+// getProbeQuestions returns the questions to send when probing for the registration's instance and host
+// names.
+func (reg *registration) getProbeQuestions() []question {
+	return []question{
+		{
+			name:         reg.serviceRecord.instanceName.String(),
+			questionType: questionTypeAny,
+		},
+		{
+			name:         reg.serviceRecord.target.String(),
+			questionType: questionTypeAny,
+		},
+	}
+}
+
+// getProbeRecords returns the records being claimed when probing for the registration's instance and host
+// names. These are included in the authority section of probes.
+func (reg *registration) getProbeRecords() []dns.RR {
+	records := []dns.RR{
+		reg.serviceRecord.toDNSRecord(),
+		reg.textRecord.toDNSRecord(),
+	}
+
+	return append(records, reg.getAddressRecords(questionTypeAny)...)
+}
+
+// isTransmitPending returns true if the registration has a probe or announcement left to send.
+func (reg *registration) isTransmitPending() bool {
+	return reg.state == registrationStateProbing || reg.state == registrationStateAnnouncing
+}
+
+// rename changes the user-friendly name of the registered service instance.
+func (reg *registration) rename(name string) {
+	instanceName := serviceInstanceName(labelEscape(name) + "." + reg.serviceRecord.serviceName.String())
+
+	reg.name = name
+	reg.pointerRecord.instanceName = instanceName
+	reg.serviceRecord.instanceName = instanceName
+	reg.textRecord.instanceName = instanceName
+}
+
+// renameHost changes the host name the registered service instance is advertised on.
+func (reg *registration) renameHost(name hostName) {
+	reg.serviceRecord.target = name
+	for i := range reg.addressRecords {
+		reg.addressRecords[i].name = name
+	}
+}
+
+// isLegacyUnicast returns true if the query was sent by a simple resolver that does not fully implement
+// mDNS and expects a conventional unicast DNS response (RFC 6762 Section 6.7).
+func (q *query) isLegacyUnicast() bool {
+	return q.source != nil && q.source.Port != mdnsPort
+}
+
+// isUnicastResponse returns true if all of the query's questions ask for a unicast response, in which case
+// the answers are sent directly to the querier (RFC 6762 Section 5.4).
+func (q *query) isUnicastResponse() bool {
+	if q.source == nil {
+		return false
+	}
+
+	for i := range q.questions {
+		if !q.questions[i].unicastResponse {
+			return false
+		}
+	}
+
+	return true
+}
+
+// toLegacyUnicastResponse converts the given response into a response to a legacy unicast query.
+func (q *query) toLegacyUnicastResponse(response *dns.Msg) *dns.Msg {
+	legacyResponse := response.Copy()
+	legacyResponse.Id = q.id
+
+	for i := range q.questions {
+		legacyResponse.Question = append(legacyResponse.Question, q.questions[i].toDNSQuestion())
+	}
+
+	maxTimeToLive := uint32(legacyUnicastTimeToLive / time.Second)
+	for _, rr := range append(legacyResponse.Answer, legacyResponse.Extra...) {
+		header := rr.Header()
+		header.Class &^= 1 << cacheFlushBit
+
+		if header.Ttl > maxTimeToLive {
+			header.Ttl = maxTimeToLive
+		}
+	}
+
+	return legacyResponse
+}
@@ -0,0 +1,480 @@
+package dnssd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type nameConflictTestCase struct {
+	state        registrationState
+	hostConflict bool
+	expectedName string
+	expectedHost hostName
+}
+
+type nextHostNameTestCase struct {
+	name         hostName
+	expectedName hostName
+}
+
+type nextInstanceNameTestCase struct {
+	name         string
+	expectedName string
+}
+
+type recordSetCompareTestCase struct {
+	ours           []dns.RR
+	theirs         []dns.RR
+	expectedResult int
+}
+
+func TestSuppressDuplicateAnswers(t *testing.T) {
+	ours := newTestPointerRecord("a")
+	other := newTestPointerRecord("b")
+
+	resolver := Resolver{
+		delayedResponse: &delayedResponse{
+			answers: []dns.RR{ours.toDNSRecord(), other.toDNSRecord()},
+		},
+	}
+
+	// Answers sent with less than half of our time-to-live do not suppress ours
+	staleOther := other
+	staleOther.remainingTimeToLive = other.remainingTimeToLive/2 - time.Second
+
+	resolver.suppressDuplicateAnswers(answerSet{
+		pointerRecords: []pointerRecord{ours, staleOther},
+	})
+
+	assert.Equal(t, []dns.RR{other.toDNSRecord()}, resolver.delayedResponse.answers)
+}
+
+func TestNextInstanceName(t *testing.T) {
+	testCases := []nextInstanceNameTestCase{
+		{name: "Printer", expectedName: "Printer (2)"},
+		{name: "Printer (2)", expectedName: "Printer (3)"},
+		{name: "Printer (9)", expectedName: "Printer (10)"},
+		{name: "Printer (two)", expectedName: "Printer (two) (2)"},
+		{name: "(2)", expectedName: "(2) (2)"},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expectedName, nextInstanceName(testCase.name))
+	}
+}
+
+func TestNextHostName(t *testing.T) {
+	testCases := []nextHostNameTestCase{
+		{name: "printer.local.", expectedName: "printer-2.local."},
+		{name: "printer-2.local.", expectedName: "printer-3.local."},
+		{name: "my-printer.local.", expectedName: "my-printer-2.local."},
+		{name: "printer-two.local.", expectedName: "printer-two-2.local."},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expectedName, nextHostName(testCase.name))
+	}
+}
+
+func TestNameConflictRegisteredProbesAgain(t *testing.T) {
+	// A conflict may be transient, so the name is only given up if probing for it fails
+	testCase := nameConflictTestCase{
+		state:        registrationStateRegistered,
+		expectedName: "Printer",
+		expectedHost: "host.local.",
+	}
+
+	testCase.run(t)
+}
+
+func TestNameConflictRegisteredHostProbesAgain(t *testing.T) {
+	testCase := nameConflictTestCase{
+		state:        registrationStateAnnouncing,
+		hostConflict: true,
+		expectedName: "Printer",
+		expectedHost: "host.local.",
+	}
+
+	testCase.run(t)
+}
+
+func TestNameConflictProbingRenames(t *testing.T) {
+	testCase := nameConflictTestCase{
+		state:        registrationStateProbing,
+		expectedName: "Printer (2)",
+		expectedHost: "host.local.",
+	}
+
+	testCase.run(t)
+}
+
+func TestNameConflictProbingHostRenamesHost(t *testing.T) {
+	testCase := nameConflictTestCase{
+		state:        registrationStateProbing,
+		hostConflict: true,
+		expectedName: "Printer",
+		expectedHost: "host-2.local.",
+	}
+
+	testCase.run(t)
+}
+
+func TestCheckForNameConflictsHostAddress(t *testing.T) {
+	reg := newTestRegistration(t)
+	reg.state = registrationStateRegistered
+
+	resolver := Resolver{
+		clock:             SystemClock(),
+		localAddresses:    []net.IP{net.IPv4(192, 168, 1, 2)},
+		registrationTimer: timerCreate(SystemClock()),
+		registrations:     map[serviceInstanceName]*registration{reg.serviceRecord.instanceName: &reg},
+	}
+
+	answers := answerSet{
+		addressRecords: []addressRecord{
+			reg.addressRecords[0],
+			{
+				address:        net.IPv4(192, 168, 1, 3),
+				name:           "HOST.local.",
+				resourceRecord: newUniqueResourceRecord(hostRecordTimeToLive),
+			},
+		},
+		source: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: mdnsPort},
+	}
+
+	// Other responders on our own host may publish more addresses for the host name
+	resolver.checkForNameConflicts(answers)
+	assert.Equal(t, registrationStateRegistered, reg.state)
+
+	answers.source = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 3), Port: mdnsPort}
+	resolver.checkForNameConflicts(answers)
+	assert.Equal(t, registrationStateProbing, reg.state)
+	assert.Equal(t, hostName("host.local."), reg.serviceRecord.target)
+}
+
+func TestProbeClaimsHostName(t *testing.T) {
+	reg := newTestRegistration(t)
+
+	assert.Equal(t, []question{
+		{name: "Printer._ipp._tcp.local.", questionType: questionTypeAny},
+		{name: "host.local.", questionType: questionTypeAny},
+	}, reg.getProbeQuestions())
+	assert.Equal(t, reg.addressRecords[0].toDNSRecord(), reg.getProbeRecords()[2])
+}
+
+func TestTruncatedQueryWaitsForKnownAnswers(t *testing.T) {
+	reg := newTestRegistration(t)
+	reg.state = registrationStateRegistered
+
+	transport := newMockTransport()
+	resolver := Resolver{
+		clock:               SystemClock(),
+		netClient:           netClient{transport: transport},
+		registrations:       map[serviceInstanceName]*registration{reg.serviceRecord.instanceName: &reg},
+		truncatedQueryTimer: timerCreate(SystemClock()),
+	}
+
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 3), Port: mdnsPort}
+	start := time.Now()
+
+	resolver.onQueryReceived(query{
+		questions: []question{
+			{name: reg.serviceRecord.instanceName.String(), questionType: questionTypeService},
+			{name: reg.serviceRecord.instanceName.String(), questionType: questionTypeText},
+		},
+		source:    source,
+		truncated: true,
+	})
+
+	// The rest of the known answers follows in another packet from the same host
+	resolver.onQueryReceived(query{
+		knownAnswers: []dns.RR{reg.serviceRecord.toDNSRecord()},
+		source:       source,
+	})
+	assert.Empty(t, transport.sentCh)
+
+	select {
+	case <-resolver.truncatedQueryTimer.C():
+		resolver.onTruncatedQueryTimer()
+	case <-time.After(time.Second):
+		t.Fatal("truncated query was not answered")
+	}
+
+	assert.True(t, time.Since(start) >= minTruncatedResponseDelay)
+	assert.Empty(t, resolver.truncatedQueries)
+
+	sent := <-transport.sentCh
+	assert.Equal(t, []dns.RR{reg.textRecord.toDNSRecord()}, sent.msg.Answer)
+}
+
+func TestNewRegistrationEscapedTextRecord(t *testing.T) {
+	// Quotes and backslashes are escaped in the TXT record's presentation format, but are sent as single
+	// bytes, so attributes close to the size limit are still valid.
+	path := strings.Repeat(`"\\`, 80)
+
+	reg, err := newRegistration(ServiceRegistration{
+		Addresses:   []net.IP{net.IPv4(192, 168, 1, 2)},
+		HostName:    "host.local.",
+		Name:        "Printer",
+		Port:        631,
+		ServiceName: "_ipp._tcp.local.",
+		TextRecords: map[string]string{"path": path},
+	}, nil)
+	assert.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{reg.textRecord.toDNSRecord()}
+
+	packed, err := msg.Pack()
+	assert.NoError(t, err)
+
+	assert.NoError(t, msg.Unpack(packed))
+	record, ok := txtToTextRecord(msg.Answer[0].(*dns.TXT))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"path": path}, record.values)
+}
+
+func TestNewRegistrationEmptyTextRecordValue(t *testing.T) {
+	reg, err := newRegistration(ServiceRegistration{
+		Addresses:   []net.IP{net.IPv4(192, 168, 1, 2)},
+		HostName:    "host.local.",
+		Name:        "Printer",
+		Port:        631,
+		ServiceName: "_ipp._tcp.local.",
+		TextRecords: map[string]string{"note": ""},
+	}, nil)
+	assert.NoError(t, err)
+
+	// An empty value is published with '=' so that it is not mistaken for a boolean attribute
+	assert.Equal(t, []string{"note="}, reg.textRecord.toDNSRecord().(*dns.TXT).Txt)
+}
+
+func TestNewRegistrationRawTextRecords(t *testing.T) {
+	reg, err := newRegistration(ServiceRegistration{
+		Addresses:      []net.IP{net.IPv4(192, 168, 1, 2)},
+		HostName:       "host.local.",
+		Name:           "Printer",
+		Port:           631,
+		ServiceName:    "_ipp._tcp.local.",
+		TextRecordsRaw: [][]byte{[]byte("duplex"), []byte("note=")},
+	}, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"duplex", "note="}, reg.textRecord.toDNSRecord().(*dns.TXT).Txt)
+	assert.Equal(t, map[string]string{"duplex": "", "note": ""}, reg.textRecord.values)
+}
+
+func TestNewRegistrationTextRecordsAndRaw(t *testing.T) {
+	_, err := newRegistration(ServiceRegistration{
+		Addresses:      []net.IP{net.IPv4(192, 168, 1, 2)},
+		HostName:       "host.local.",
+		Name:           "Printer",
+		Port:           631,
+		ServiceName:    "_ipp._tcp.local.",
+		TextRecords:    map[string]string{"note": ""},
+		TextRecordsRaw: [][]byte{[]byte("duplex")},
+	}, nil)
+
+	assert.Error(t, err)
+}
+
+func TestRecordSetCompareDifferentData(t *testing.T) {
+	testCase := recordSetCompareTestCase{
+		ours: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.99.200"),
+		},
+		theirs: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.200.50"),
+		},
+		expectedResult: -1,
+	}
+
+	testCase.run(t)
+}
+
+func TestRecordSetCompareDifferentType(t *testing.T) {
+	// RFC 6762 Section 8.2 example: a record of type A (1) is less than a record of type AAAA (28)
+	testCase := recordSetCompareTestCase{
+		ours: []dns.RR{
+			newTestAAAARecord("test_host.local.", "fe80::1"),
+		},
+		theirs: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.200.50"),
+		},
+		expectedResult: 1,
+	}
+
+	testCase.run(t)
+}
+
+func TestRecordSetCompareEqual(t *testing.T) {
+	testCase := recordSetCompareTestCase{
+		ours: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.99.200"),
+			newTestAAAARecord("test_host.local.", "fe80::1"),
+		},
+		theirs: []dns.RR{
+			newTestAAAARecord("test_host.local.", "fe80::1"),
+			newTestARecord("test_host.local.", "169.254.99.200"),
+		},
+		expectedResult: 0,
+	}
+
+	testCase.run(t)
+}
+
+func TestRecordSetCompareMoreRecords(t *testing.T) {
+	testCase := recordSetCompareTestCase{
+		ours: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.99.200"),
+			newTestARecord("test_host.local.", "169.254.99.201"),
+		},
+		theirs: []dns.RR{
+			newTestARecord("test_host.local.", "169.254.99.200"),
+		},
+		expectedResult: 1,
+	}
+
+	testCase.run(t)
+}
+
+func TestUnicastResponse(t *testing.T) {
+	resolver, transport := newTestResolver(t, WithLocalAddresses([]net.IP{net.ParseIP("10.0.0.1")}))
+
+	_, err := resolver.RegisterService(ServiceRegistration{
+		HostName:    "advertiser.local.",
+		Name:        "Living Room",
+		Port:        8080,
+		ServiceName: "_http._tcp.local.",
+	})
+	assert.NoError(t, err)
+
+	query := new(dns.Msg)
+	query.Question = []dns.Question{
+		{
+			Name:   "_http._tcp.local.",
+			Qtype:  dns.TypePTR,
+			Qclass: dns.ClassINET | 1<<unicastResponseBit,
+		},
+	}
+
+	source := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: mdnsPort}
+	transport.msgCh <- ReceivedMessage{InterfaceIndex: 1, Msg: query, Source: source}
+
+	// Skip the probes and announcements, which are multicast
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case sent := <-transport.sentCh:
+			if sent.dst != nil {
+				assert.Equal(t, source, sent.dst)
+				assert.True(t, sent.msg.Response)
+				assert.Equal(t, dns.TypePTR, sent.msg.Answer[0].Header().Rrtype)
+				return
+			}
+
+		case <-deadline:
+			t.Fatal("no unicast response sent")
+		}
+	}
+}
+
+func TestUnregisterServiceUnescapedName(t *testing.T) {
+	resolver, transport := newTestResolver(t, WithLocalAddresses([]net.IP{net.ParseIP("10.0.0.1")}))
+
+	instanceName, err := resolver.RegisterService(ServiceRegistration{
+		HostName:    "advertiser.local.",
+		Name:        "Living Room",
+		Port:        8080,
+		ServiceName: "_http._tcp.local.",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `Living\ Room._http._tcp.local.`, instanceName)
+
+	resolver.UnregisterService("living room._HTTP._tcp.local.")
+
+	// Skip the probes and announcements until the goodbye is sent
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case sent := <-transport.sentCh:
+			if sent.msg.Response && len(sent.msg.Answer) > 0 && sent.msg.Answer[0].Header().Ttl == 0 {
+				assert.Equal(t, `Living\ Room._http._tcp.local.`, sent.msg.Answer[0].(*dns.PTR).Ptr)
+				return
+			}
+
+		case <-deadline:
+			t.Fatal("no goodbye sent")
+		}
+	}
+}
+
+func (tc *nameConflictTestCase) run(t *testing.T) {
+	reg := newTestRegistration(t)
+	reg.state = tc.state
+
+	resolver := Resolver{
+		clock:             SystemClock(),
+		registrationTimer: timerCreate(SystemClock()),
+		registrations:     map[serviceInstanceName]*registration{reg.serviceRecord.instanceName: &reg},
+	}
+
+	resolver.onNameConflict(&reg, tc.hostConflict)
+
+	expectedInstanceName := serviceInstanceName(labelEscape(tc.expectedName) + "._ipp._tcp.local.")
+	assert.Equal(t, registrationStateProbing, reg.state)
+	assert.Equal(t, 0, reg.probesSent)
+	assert.Equal(t, tc.expectedName, reg.name)
+	assert.Equal(t, expectedInstanceName, reg.serviceRecord.instanceName)
+	assert.Equal(t, map[serviceInstanceName]*registration{expectedInstanceName: &reg}, resolver.registrations)
+	assert.Equal(t, tc.expectedHost, reg.serviceRecord.target)
+	assert.Equal(t, tc.expectedHost, reg.addressRecords[0].name)
+}
+
+func (tc *recordSetCompareTestCase) run(t *testing.T) {
+	result := recordSetCompare(tc.ours, tc.theirs)
+
+	switch {
+	case tc.expectedResult < 0:
+		assert.True(t, result < 0)
+	case tc.expectedResult > 0:
+		assert.True(t, result > 0)
+	default:
+		assert.Equal(t, 0, result)
+	}
+}
+
+func newTestARecord(name string, address string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+		A:   net.ParseIP(address).To4(),
+	}
+}
+
+func newTestAAAARecord(name string, address string) dns.RR {
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 120},
+		AAAA: net.ParseIP(address),
+	}
+}
+
+// newTestRegistration creates a registration of a printer on a host with a single address.
+func newTestRegistration(t *testing.T) registration {
+	reg, err := newRegistration(ServiceRegistration{
+		Addresses:   []net.IP{net.IPv4(192, 168, 1, 2)},
+		HostName:    "host.local.",
+		Name:        "Printer",
+		Port:        631,
+		ServiceName: "_ipp._tcp.local.",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reg
+}
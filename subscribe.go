@@ -0,0 +1,244 @@
+package dnssd
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"sort"
+)
+
+// subscribeRequest contains all data to request notifications of changes to a service's instances.
+type subscribeRequest struct {
+	responseCh  chan (<-chan ServiceEvent)
+	serviceName serviceName
+}
+
+// subscription delivers events for a single service to a subscriber.
+type subscription struct {
+	eventCh     chan ServiceEvent // Events published by the resolver
+	outCh       chan ServiceEvent // Events delivered to the subscriber
+	serviceName serviceName
+}
+
+// instancesByName groups the given resolved instances by instance name. Each group is sorted by address.
+func instancesByName(instances map[serviceInstanceID]ServiceInstance) map[string][]ServiceInstance {
+	byName := make(map[string][]ServiceInstance)
+	for _, instance := range instances {
+		byName[instance.InstanceName] = append(byName[instance.InstanceName], instance)
+	}
+
+	for _, group := range byName {
+		sort.Slice(group, func(i, j int) bool {
+			return bytes.Compare(group[i].Address, group[j].Address) < 0
+		})
+	}
+
+	return byName
+}
+
+// instancesOfService returns the subset of the given resolved instances that belong to the service with
+// the given name.
+func instancesOfService(instances map[serviceInstanceID]ServiceInstance, name serviceName) map[serviceInstanceID]ServiceInstance {
+	ofService := make(map[serviceInstanceID]ServiceInstance)
+	for id, instance := range instances {
+		if instance.isInstanceOf(name) {
+			ofService[id] = instance
+		}
+	}
+
+	return ofService
+}
+
+// newSubscription creates a new subscription to the given service and starts delivering its events.
+func newSubscription(name serviceName) *subscription {
+	s := &subscription{
+		eventCh:     make(chan ServiceEvent),
+		outCh:       make(chan ServiceEvent),
+		serviceName: name,
+	}
+
+	go s.forward()
+
+	return s
+}
+
+// getServiceEvents returns the events describing the changes from the old to the new set of resolved
+// instances.
+func (r *Resolver) getServiceEvents(oldInstances, newInstances map[serviceInstanceID]ServiceInstance) []ServiceEvent {
+	events := make([]ServiceEvent, 0)
+	oldByName := instancesByName(oldInstances)
+	newByName := instancesByName(newInstances)
+
+	for name, instances := range newByName {
+		oldGroup, ok := oldByName[name]
+		if !ok {
+			events = append(events, ServiceEvent{
+				InstanceName: name,
+				Instances:    instances,
+				ServiceName:  instances[0].ServiceName,
+				Type:         ServiceEventAdded,
+			})
+		} else if !reflect.DeepEqual(oldGroup, instances) {
+			events = append(events, ServiceEvent{
+				InstanceName: name,
+				Instances:    instances,
+				ServiceName:  instances[0].ServiceName,
+				Type:         ServiceEventUpdated,
+			})
+		}
+	}
+
+	for name, instances := range oldByName {
+		if _, ok := newByName[name]; ok {
+			continue
+		}
+
+		reason := r.cache.getRemovalReason(serviceInstanceName(name))
+
+		events = append(events, ServiceEvent{
+			InstanceName: name,
+			Instances:    instances,
+			Reason:       reason,
+			ServiceName:  instances[0].ServiceName,
+			Type:         ServiceEventRemoved,
+		})
+	}
+
+	return events
+}
+
+// getServiceTypeEvents returns the events describing the changes from the old to the new set of
+// discovered service types.
+func (r *Resolver) getServiceTypeEvents(oldTypes, newTypes map[serviceName]bool) []ServiceEvent {
+	events := make([]ServiceEvent, 0)
+
+	for serviceType := range newTypes {
+		if !oldTypes[serviceType] {
+			events = append(events, ServiceEvent{
+				ServiceName: serviceType.String(),
+				Type:        ServiceEventAdded,
+			})
+		}
+	}
+
+	for serviceType := range oldTypes {
+		if newTypes[serviceType] {
+			continue
+		}
+
+		pointer := r.cache.pointerRecords[pointerRecordID{name: serviceInstanceName(serviceType)}]
+		reason := getRemovalReason([]resourceRecord{pointer.resourceRecord})
+
+		events = append(events, ServiceEvent{
+			Reason:      reason,
+			ServiceName: serviceType.String(),
+			Type:        ServiceEventRemoved,
+		})
+	}
+
+	return events
+}
+
+// notifyServiceTypeSubscribers publishes events describing the changes from the old to the new set of
+// discovered service types to all service type subscribers.
+func (r *Resolver) notifyServiceTypeSubscribers(oldTypes, newTypes map[serviceName]bool) {
+	if len(r.subscriptions) == 0 {
+		return
+	}
+
+	for _, event := range r.getServiceTypeEvents(oldTypes, newTypes) {
+		for _, s := range r.subscriptions {
+			if s.serviceName == serviceTypeEnumerationName {
+				s.eventCh <- event
+			}
+		}
+	}
+}
+
+// notifySubscribers publishes events describing the changes from the old to the new set of resolved
+// instances to all interested subscribers. Events are computed per subscription so that subscribers to
+// a subtype see an instance removed once it is no longer found under that subtype.
+func (r *Resolver) notifySubscribers(oldInstances, newInstances map[serviceInstanceID]ServiceInstance) {
+	for _, s := range r.subscriptions {
+		if s.serviceName == serviceTypeEnumerationName {
+			continue
+		}
+
+		oldOfService := instancesOfService(oldInstances, s.serviceName)
+		newOfService := instancesOfService(newInstances, s.serviceName)
+
+		for _, event := range r.getServiceEvents(oldOfService, newOfService) {
+			s.eventCh <- event
+		}
+	}
+}
+
+// onSubscribe handles a request to subscribe to changes to the instances of a service. The subscriber
+// is immediately notified of all instances that are already resolved.
+func (r *Resolver) onSubscribe(request subscribeRequest) {
+	log.Printf("Adding subscription to service %v\n", request.serviceName)
+
+	s := newSubscription(request.serviceName)
+	r.subscriptions = append(r.subscriptions, s)
+	request.responseCh <- s.outCh
+
+	r.onServiceAdded(request.serviceName)
+
+	if request.serviceName == serviceTypeEnumerationName {
+		for _, event := range r.getServiceTypeEvents(make(map[serviceName]bool), r.serviceTypes) {
+			s.eventCh <- event
+		}
+
+		return
+	}
+
+	noInstances := make(map[serviceInstanceID]ServiceInstance)
+	for _, event := range r.getServiceEvents(noInstances, instancesOfService(r.resolvedInstances, s.serviceName)) {
+		s.eventCh <- event
+	}
+}
+
+// onUnsubscribe handles a request to cancel the subscription delivering events on the given channel.
+func (r *Resolver) onUnsubscribe(ch <-chan ServiceEvent) {
+	for i, s := range r.subscriptions {
+		if (<-chan ServiceEvent)(s.outCh) == ch {
+			s.close()
+			r.subscriptions = append(r.subscriptions[:i], r.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// close stops delivering events to the subscriber and closes the subscriber's channel. Any
+// undelivered events are discarded.
+func (s *subscription) close() {
+	close(s.eventCh)
+}
+
+// forward delivers events published by the resolver to the subscriber. Events are queued so that a
+// slow subscriber never blocks the resolver.
+func (s *subscription) forward() {
+	defer close(s.outCh)
+
+	queue := make([]ServiceEvent, 0)
+	for {
+		var outCh chan ServiceEvent
+		var next ServiceEvent
+		if len(queue) > 0 {
+			outCh = s.outCh
+			next = queue[0]
+		}
+
+		select {
+		case event, ok := <-s.eventCh:
+			if !ok {
+				return
+			}
+
+			queue = append(queue, event)
+
+		case outCh <- next:
+			queue = queue[1:]
+		}
+	}
+}
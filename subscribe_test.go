@@ -0,0 +1,216 @@
+package dnssd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type getServiceEventsTestCase struct {
+	cache          mockCache
+	oldInstances   []ServiceInstance
+	newInstances   []ServiceInstance
+	expectedEvents []ServiceEvent
+}
+
+func TestGetServiceEventsAdded(t *testing.T) {
+	instance := newTestServiceInstance("172.16.6.0", 9871)
+
+	testCase := getServiceEventsTestCase{
+		oldInstances: []ServiceInstance{},
+		newInstances: []ServiceInstance{instance},
+		expectedEvents: []ServiceEvent{
+			{
+				InstanceName: instance.InstanceName,
+				Instances:    []ServiceInstance{instance},
+				ServiceName:  instance.ServiceName,
+				Type:         ServiceEventAdded,
+			},
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceEventsAddressAdded(t *testing.T) {
+	instance := newTestServiceInstance("172.16.6.0", 9871)
+	otherAddressInstance := newTestServiceInstance("172.16.6.197", 9871)
+
+	testCase := getServiceEventsTestCase{
+		oldInstances: []ServiceInstance{instance},
+		newInstances: []ServiceInstance{instance, otherAddressInstance},
+		expectedEvents: []ServiceEvent{
+			{
+				InstanceName: instance.InstanceName,
+				Instances:    []ServiceInstance{instance, otherAddressInstance},
+				ServiceName:  instance.ServiceName,
+				Type:         ServiceEventUpdated,
+			},
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceEventsNoChange(t *testing.T) {
+	instance := newTestServiceInstance("172.16.6.0", 9871)
+
+	testCase := getServiceEventsTestCase{
+		oldInstances:   []ServiceInstance{instance},
+		newInstances:   []ServiceInstance{instance},
+		expectedEvents: []ServiceEvent{},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceEventsPortUpdated(t *testing.T) {
+	oldInstance := newTestServiceInstance("172.16.6.0", 9871)
+	newInstance := newTestServiceInstance("172.16.6.0", 9872)
+
+	testCase := getServiceEventsTestCase{
+		oldInstances: []ServiceInstance{oldInstance},
+		newInstances: []ServiceInstance{newInstance},
+		expectedEvents: []ServiceEvent{
+			{
+				InstanceName: newInstance.InstanceName,
+				Instances:    []ServiceInstance{newInstance},
+				ServiceName:  newInstance.ServiceName,
+				Type:         ServiceEventUpdated,
+			},
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceEventsRemovedExpired(t *testing.T) {
+	instance := newTestServiceInstance("172.16.6.0", 9871)
+
+	testCase := getServiceEventsTestCase{
+		oldInstances: []ServiceInstance{instance},
+		newInstances: []ServiceInstance{},
+		expectedEvents: []ServiceEvent{
+			{
+				InstanceName: instance.InstanceName,
+				Instances:    []ServiceInstance{instance},
+				Reason:       RemovalReasonExpired,
+				ServiceName:  instance.ServiceName,
+				Type:         ServiceEventRemoved,
+			},
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceEventsRemovedGoodbye(t *testing.T) {
+	instance := newTestServiceInstance("172.16.6.0", 9871)
+
+	cache := mockCache{
+		serviceRecords: []serviceRecord{
+			serviceRecord{
+				instanceName: "test instance._test_service",
+				serviceName:  "_test_service",
+				port:         9871,
+				target:       "test_host",
+				resourceRecord: resourceRecord{
+					goodbye:             true,
+					remainingTimeToLive: time.Second,
+				},
+			},
+		},
+	}
+
+	testCase := getServiceEventsTestCase{
+		cache:        cache,
+		oldInstances: []ServiceInstance{instance},
+		newInstances: []ServiceInstance{},
+		expectedEvents: []ServiceEvent{
+			{
+				InstanceName: instance.InstanceName,
+				Instances:    []ServiceInstance{instance},
+				Reason:       RemovalReasonGoodbye,
+				ServiceName:  instance.ServiceName,
+				Type:         ServiceEventRemoved,
+			},
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestGetServiceTypeEvents(t *testing.T) {
+	cache := mockCache{
+		pointerRecords: []pointerRecord{
+			pointerRecord{
+				instanceName: "_ipp._tcp.local.",
+				serviceName:  serviceTypeEnumerationName,
+				resourceRecord: resourceRecord{
+					goodbye:             true,
+					remainingTimeToLive: time.Second,
+				},
+			},
+		},
+	}
+
+	resolver := Resolver{
+		cache: cache.toCache(),
+	}
+
+	oldTypes := map[serviceName]bool{
+		"_http._tcp.local.": true,
+		"_ipp._tcp.local.":  true,
+		"_ssh._tcp.local.":  true,
+	}
+
+	newTypes := map[serviceName]bool{
+		"_http._tcp.local.":       true,
+		"_googlecast._tcp.local.": true,
+	}
+
+	expectedEvents := []ServiceEvent{
+		{
+			ServiceName: "_googlecast._tcp.local.",
+			Type:        ServiceEventAdded,
+		},
+		{
+			Reason:      RemovalReasonGoodbye,
+			ServiceName: "_ipp._tcp.local.",
+			Type:        ServiceEventRemoved,
+		},
+		{
+			Reason:      RemovalReasonExpired,
+			ServiceName: "_ssh._tcp.local.",
+			Type:        ServiceEventRemoved,
+		},
+	}
+
+	events := resolver.getServiceTypeEvents(oldTypes, newTypes)
+
+	assert.ElementsMatch(t, expectedEvents, events)
+}
+
+func (tc *getServiceEventsTestCase) run(t *testing.T) {
+	resolver := Resolver{
+		cache: tc.cache.toCache(),
+	}
+
+	events := resolver.getServiceEvents(serviceInstancesToMap(tc.oldInstances), serviceInstancesToMap(tc.newInstances))
+
+	assert.Equal(t, tc.expectedEvents, events)
+}
+
+func newTestServiceInstance(address string, port uint16) ServiceInstance {
+	return ServiceInstance{
+		Address:      net.ParseIP(address),
+		InstanceName: "test instance._test_service",
+		Port:         port,
+		ServiceName:  "_test_service",
+		TextRecords: map[string]string{
+			"hello": "world",
+		},
+	}
+}
@@ -0,0 +1,49 @@
+package dnssd
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ReceivedMessage is a DNS message received by a transport.
+type ReceivedMessage struct {
+	InterfaceIndex int // Index of the interface on which the message was received, or 0 if unknown
+	Msg            *dns.Msg
+	Source         *net.UDPAddr
+}
+
+// Transport sends and receives the mDNS messages of a resolver. The default transport created by
+// NewResolver uses UDP multicast sockets on the resolver's interfaces; other implementations allow a
+// resolver to run over other networks, such as a simulated network in tests.
+type Transport interface {
+	// Close stops receiving messages and releases all resources held by the transport.
+	Close() error
+	// Receive returns the channel on which all received messages are delivered.
+	Receive() <-chan ReceivedMessage
+	// Send sends the given message to the given address. If the address is nil, the message is multicast
+	// to the mDNS group on all interfaces. Messages must be sent from the mDNS port, as queries from any
+	// other port are answered as one-shot queries (RFC 6762 Sections 5.2 and 6.7).
+	Send(msg *dns.Msg, dst *net.UDPAddr) error
+}
+
+// AddressedTransport is a transport that knows the addresses of the interfaces it sends messages from. A
+// resolver on such a transport recognizes its own queries when they are looped back to it, rather than
+// treating them as queries from other hosts. The default transport and simulated hosts of the dnssdtest
+// package implement it.
+type AddressedTransport interface {
+	Transport
+	// Addresses returns the addresses of the transport's interfaces.
+	Addresses() []net.IP
+}
+
+// ResolverOption configures optional behavior of a resolver created with NewResolverWithTransport.
+type ResolverOption func(r *Resolver)
+
+// WithLocalAddresses sets the addresses advertised for registered service instances that do not specify
+// their own addresses.
+func WithLocalAddresses(addresses []net.IP) ResolverOption {
+	return func(r *Resolver) {
+		r.localAddresses = addresses
+	}
+}
@@ -0,0 +1,109 @@
+package dnssd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMessage struct {
+	msg *dns.Msg
+	dst *net.UDPAddr
+}
+
+// mockTransport records all sent messages and delivers messages injected by the test.
+type mockTransport struct {
+	closed bool
+	msgCh  chan ReceivedMessage
+	sentCh chan sentMessage
+}
+
+func newMockTransport() *mockTransport {
+	return &mockTransport{
+		msgCh:  make(chan ReceivedMessage),
+		sentCh: make(chan sentMessage, 16),
+	}
+}
+
+func (t *mockTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+func (t *mockTransport) Receive() <-chan ReceivedMessage {
+	return t.msgCh
+}
+
+func (t *mockTransport) Send(msg *dns.Msg, dst *net.UDPAddr) error {
+	t.sentCh <- sentMessage{msg: msg, dst: dst}
+	return nil
+}
+
+// newTestResolver creates a resolver on a new mock transport. The resolver is closed when the test ends.
+func newTestResolver(t *testing.T, options ...ResolverOption) (*Resolver, *mockTransport) {
+	transport := newMockTransport()
+
+	resolver, err := NewResolverWithTransport(transport, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(resolver.Close)
+
+	return &resolver, transport
+}
+
+func TestResolverWithTransportBrowse(t *testing.T) {
+	transport := newMockTransport()
+
+	resolver, err := NewResolverWithTransport(transport)
+	assert.NoError(t, err)
+
+	resolver.BrowseService("_http._tcp.local.")
+
+	sent := <-transport.sentCh
+	assert.Nil(t, sent.dst)
+	assert.Equal(t, []dns.Question{
+		{
+			Name:   "_http._tcp.local.",
+			Qtype:  dns.TypePTR,
+			Qclass: dns.ClassINET,
+		},
+	}, sent.msg.Question)
+
+	resolver.Close()
+	assert.True(t, transport.closed)
+}
+
+// newLivingRoomResponse creates a response containing all records of the "Living Room" instance of the
+// _http._tcp service with the given time-to-live in seconds.
+func newLivingRoomResponse(ttl uint32) *dns.Msg {
+	header := func(name string, rrType uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	response := new(dns.Msg)
+	response.Response = true
+	response.Answer = []dns.RR{
+		&dns.PTR{
+			Hdr: header("_http._tcp.local.", dns.TypePTR),
+			Ptr: `Living\ Room._http._tcp.local.`,
+		},
+		&dns.SRV{
+			Hdr:    header(`Living\ Room._http._tcp.local.`, dns.TypeSRV),
+			Port:   8080,
+			Target: "living-room.local.",
+		},
+		&dns.TXT{
+			Hdr: header(`Living\ Room._http._tcp.local.`, dns.TypeTXT),
+			Txt: []string{"path=/"},
+		},
+		&dns.A{
+			Hdr: header("living-room.local.", dns.TypeA),
+			A:   net.ParseIP("10.0.0.1").To4(),
+		},
+	}
+
+	return response
+}
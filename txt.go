@@ -0,0 +1,295 @@
+package dnssd
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxTextStringLength = 255  // Maximum length of a single TXT record string (RFC 6763 Section 6.1)
+	maxTextRecordLength = 1300 // Recommended maximum total size of a TXT record (RFC 6763 Section 6.2)
+)
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// txtField describes a struct field that is marshaled to or unmarshaled from a TXT record attribute.
+type txtField struct {
+	index     int
+	key       string
+	omitEmpty bool
+}
+
+// MarshalTXT converts the given struct, or pointer to struct, into TXT record strings suitable for
+// ServiceRegistration.TextRecordsRaw. Each exported field is stored as a "key=value" string under the key
+// given by its `txt` struct tag, or under its lower case field name if it has no tag. Fields tagged
+// `txt:"-"` are skipped, and fields tagged with the "omitempty" option are skipped if they have their zero
+// value. Boolean fields are stored as boolean attributes, which are a bare key when true and omitted when
+// false, so that they remain distinct from empty values.
+//
+// Supported field types are strings, booleans, integers, floats, byte slices, and types implementing
+// encoding.TextMarshaler. An error is returned if a string exceeds 255 bytes or the strings together
+// exceed the recommended TXT record size of 1300 bytes.
+func MarshalTXT(v interface{}) ([][]byte, error) {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("dnssd: cannot marshal %T into TXT record", v)
+	}
+
+	txt := make([][]byte, 0)
+	for _, field := range txtFields(value.Type()) {
+		fieldValue := value.Field(field.index)
+		if field.omitEmpty && isZero(fieldValue) {
+			continue
+		}
+
+		if fieldValue.Kind() == reflect.Bool && !fieldValue.Type().Implements(textMarshalerType) {
+			// Boolean attributes are present without a value when true and absent when false
+			// (RFC 6763 Section 6.4)
+			if fieldValue.Bool() {
+				txt = append(txt, []byte(field.key))
+			}
+
+			continue
+		}
+
+		text, err := marshalTXTValue(fieldValue)
+		if err != nil {
+			return nil, fmt.Errorf("dnssd: cannot marshal TXT record key %q: %v", field.key, err)
+		}
+
+		txt = append(txt, []byte(field.key+"="+text))
+	}
+
+	if err := validateTXTStrings(txt); err != nil {
+		return nil, err
+	}
+
+	return txt, nil
+}
+
+// UnmarshalTXT stores the given TXT record attributes, such as ServiceInstance.TextRecords, into the struct
+// pointed to by v. Fields are matched to keys as described for MarshalTXT, ignoring case. Fields whose key
+// is not present are left unchanged. A boolean field is set to true if its key is present as a boolean
+// attribute without a value.
+func UnmarshalTXT(values map[string]string, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("dnssd: cannot unmarshal TXT record into %T", v)
+	}
+
+	lowerValues := make(map[string]string, len(values))
+	for key, text := range values {
+		lowerKey := strings.ToLower(key)
+		if _, ok := lowerValues[lowerKey]; !ok {
+			lowerValues[lowerKey] = text
+		}
+	}
+
+	value = value.Elem()
+	for _, field := range txtFields(value.Type()) {
+		text, ok := lowerValues[strings.ToLower(field.key)]
+		if !ok {
+			continue
+		}
+
+		if err := unmarshalTXTValue(text, value.Field(field.index)); err != nil {
+			return fmt.Errorf("dnssd: cannot unmarshal TXT record key %q: %v", field.key, err)
+		}
+	}
+
+	return nil
+}
+
+// isZero returns true if the given value is the zero value of its type.
+func isZero(value reflect.Value) bool {
+	return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
+
+// marshalTXTValue converts the given field value into the value of a TXT record attribute.
+func marshalTXTValue(value reflect.Value) (string, error) {
+	if value.Type().Implements(textMarshalerType) {
+		text, err := value.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), nil
+
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return string(value.Bytes()), nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported type %v", value.Type())
+}
+
+// txtFields returns the fields of the given struct type that are marshaled to TXT record attributes.
+func txtFields(structType reflect.Type) []txtField {
+	fields := make([]txtField, 0, structType.NumField())
+
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if structField.PkgPath != "" {
+			// Unexported field
+			continue
+		}
+
+		tag := structField.Tag.Get("txt")
+		if tag == "-" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		field := txtField{
+			index: i,
+			key:   options[0],
+		}
+
+		if field.key == "" {
+			field.key = strings.ToLower(structField.Name)
+		}
+
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// unmarshalTXTValue stores the value of a TXT record attribute into the given field value.
+func unmarshalTXTValue(text string, value reflect.Value) error {
+	if value.Addr().Type().Implements(textUnmarshalerType) {
+		return value.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+
+	case reflect.Bool:
+		if text == "" {
+			// Boolean attribute (RFC 6763 Section 6.4)
+			value.SetBool(true)
+			return nil
+		}
+
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+
+		value.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		value.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		value.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		value.SetFloat(f)
+
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %v", value.Type())
+		}
+
+		value.SetBytes([]byte(text))
+
+	default:
+		return fmt.Errorf("unsupported type %v", value.Type())
+	}
+
+	return nil
+}
+
+// validateTXT returns an error if the given attributes cannot be published in a TXT record. Keys must not
+// contain '=' and their "key=value" strings must be valid as described for validateTXTStrings.
+func validateTXT(values map[string]string) error {
+	for key := range values {
+		if strings.Contains(key, "=") {
+			return fmt.Errorf("dnssd: invalid TXT record key %q", key)
+		}
+	}
+
+	return validateTXTStrings(mapToTXT(values))
+}
+
+// validateTXTStrings returns an error if the given strings cannot be published in a TXT record. Each
+// string must start with a non-empty printable ASCII key (RFC 6763 Section 6.4) and fit into 255 bytes, and
+// the record should not exceed 1300 bytes in total.
+func validateTXTStrings(txt [][]byte) error {
+	totalLength := 0
+	for _, attribute := range txt {
+		key := attribute
+		if i := bytes.IndexByte(attribute, '='); i >= 0 {
+			key = attribute[:i]
+		}
+
+		if len(key) == 0 {
+			return fmt.Errorf("dnssd: TXT record key must not be empty")
+		}
+
+		for i := 0; i < len(key); i++ {
+			if key[i] < ' ' || key[i] > '~' {
+				return fmt.Errorf("dnssd: invalid TXT record key %q", key)
+			}
+		}
+
+		if len(attribute) > maxTextStringLength {
+			return fmt.Errorf("dnssd: TXT record string for key %q is %d bytes, exceeding %d bytes", key,
+				len(attribute), maxTextStringLength)
+		}
+
+		// Each string is preceded by its length byte
+		totalLength += 1 + len(attribute)
+	}
+
+	if totalLength > maxTextRecordLength {
+		return fmt.Errorf("dnssd: TXT record is %d bytes, exceeding %d bytes", totalLength, maxTextRecordLength)
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package dnssd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type txtTestMetadata struct {
+	Address  net.IP `txt:"addr"`
+	Beta     bool   `txt:"beta,omitempty"`
+	Internal string `txt:"-"`
+	Key      []byte `txt:"key,omitempty"`
+	Path     string
+	Ratio    float64 `txt:"ratio"`
+	Version  int     `txt:"ver"`
+	secret   string
+}
+
+type marshalTXTTestCase struct {
+	value         interface{}
+	expectedTXT   []string
+	expectedError bool
+}
+
+type unmarshalTXTTestCase struct {
+	values        map[string]string
+	expectedValue txtTestMetadata
+	expectedError bool
+}
+
+func TestMarshalTXT(t *testing.T) {
+	testCase := marshalTXTTestCase{
+		value: &txtTestMetadata{
+			Address:  net.ParseIP("172.16.6.0"),
+			Beta:     true,
+			Internal: "hidden",
+			Key:      []byte{0, 255},
+			Path:     "/api",
+			Ratio:    0.5,
+			Version:  2,
+			secret:   "hidden",
+		},
+		expectedTXT: []string{
+			"addr=172.16.6.0",
+			"beta",
+			"key=\x00\xff",
+			"path=/api",
+			"ratio=0.5",
+			"ver=2",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestMarshalTXTOmitEmpty(t *testing.T) {
+	testCase := marshalTXTTestCase{
+		value: txtTestMetadata{
+			Address: net.ParseIP("172.16.6.0"),
+		},
+		expectedTXT: []string{
+			"addr=172.16.6.0",
+			"path=",
+			"ratio=0",
+			"ver=0",
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestMarshalTXTRoundTrip(t *testing.T) {
+	for _, beta := range []bool{true, false} {
+		txt, err := MarshalTXT(txtTestMetadata{Beta: beta})
+		assert.NoError(t, err)
+
+		// Publish the strings in a TXT record and parse them again as a browser would
+		reg := textRecord{
+			instanceName: "Printer._http._tcp.local.",
+			raw:          txt,
+		}
+		received, ok := txtToTextRecord(reg.toDNSRecord().(*dns.TXT))
+		assert.True(t, ok)
+		assert.Equal(t, beta, containsTXT(received.raw, "beta"))
+		assert.True(t, containsTXT(received.raw, "path="))
+
+		var value txtTestMetadata
+		assert.NoError(t, UnmarshalTXT(received.values, &value))
+		assert.Equal(t, beta, value.Beta)
+		assert.Equal(t, "", value.Path)
+	}
+}
+
+func TestMarshalTXTNotStruct(t *testing.T) {
+	testCase := marshalTXTTestCase{
+		value:         "path=/api",
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestMarshalTXTStringTooLong(t *testing.T) {
+	testCase := marshalTXTTestCase{
+		value: txtTestMetadata{
+			Path: strings.Repeat("a", 251),
+		},
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestMarshalTXTRecordTooLong(t *testing.T) {
+	type metadata struct {
+		A string `txt:"a"`
+		B string `txt:"b"`
+		C string `txt:"c"`
+		D string `txt:"d"`
+		E string `txt:"e"`
+		F string `txt:"f"`
+	}
+
+	value := strings.Repeat("a", 250)
+
+	testCase := marshalTXTTestCase{
+		value:         metadata{value, value, value, value, value, value},
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestUnmarshalTXT(t *testing.T) {
+	testCase := unmarshalTXTTestCase{
+		values: map[string]string{
+			"addr":    "172.16.6.0",
+			"beta":    "",
+			"key":     "\x00\xff",
+			"path":    "/api",
+			"ratio":   "0.5",
+			"VER":     "2",
+			"unknown": "value",
+		},
+		expectedValue: txtTestMetadata{
+			Address: net.ParseIP("172.16.6.0"),
+			Beta:    true,
+			Key:     []byte{0, 255},
+			Path:    "/api",
+			Ratio:   0.5,
+			Version: 2,
+		},
+	}
+
+	testCase.run(t)
+}
+
+func TestUnmarshalTXTInvalidValue(t *testing.T) {
+	testCase := unmarshalTXTTestCase{
+		values: map[string]string{
+			"ver": "two",
+		},
+		expectedError: true,
+	}
+
+	testCase.run(t)
+}
+
+func TestValidateTXTInvalidKey(t *testing.T) {
+	err := validateTXT(map[string]string{"a=b": "c"})
+
+	assert.Error(t, err)
+}
+
+func TestValidateTXTStringsEmptyKey(t *testing.T) {
+	err := validateTXTStrings([][]byte{[]byte("=value")})
+
+	assert.Error(t, err)
+}
+
+func (tc *marshalTXTTestCase) run(t *testing.T) {
+	txt, err := MarshalTXT(tc.value)
+
+	if tc.expectedError {
+		assert.Error(t, err)
+		return
+	}
+
+	expectedTXT := make([][]byte, 0, len(tc.expectedTXT))
+	for _, text := range tc.expectedTXT {
+		expectedTXT = append(expectedTXT, []byte(text))
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, expectedTXT, txt)
+}
+
+func (tc *unmarshalTXTTestCase) run(t *testing.T) {
+	var value txtTestMetadata
+	err := UnmarshalTXT(tc.values, &value)
+
+	if tc.expectedError {
+		assert.Error(t, err)
+		return
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, tc.expectedValue, value)
+}
+
+// containsTXT returns true if the given TXT record strings contain the given string.
+func containsTXT(txt [][]byte, text string) bool {
+	for _, value := range txt {
+		if string(value) == text {
+			return true
+		}
+	}
+
+	return false
+}